@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/NeuronInnovations/neuron-go-hedera-sdk/types"
+)
+
+// errorCodes lists every code a WSMessage of type "error" can carry, for the API documents
+var errorCodes = []struct {
+	Code        string
+	Description string
+}{
+	{"PARSE_ERROR", "The message or its data is not valid JSON of the expected shape"},
+	{"INVALID_DATA", "The message data cannot be sent, e.g. it is missing or has the wrong type"},
+	{"MISSING_PUBLIC_KEY", "A P2P send without a publicKey or publicKeys"},
+	{"INVALID_PUBLIC_KEY", "The publicKey is not a valid Hedera public key"},
+	{"PEER_ID_DECODE_ERROR", "The peer ID derived from the publicKey cannot be decoded"},
+	{"INVALID_PROTOCOL", "The protocol is not served by this node, or not the one of the endpoint"},
+	{"PEER_NOT_FOUND", "There is no connection to the target peer"},
+	{"SEND_ERROR", "Writing to the target peer failed"},
+	{"MESSAGE_TOO_LARGE", "The payload or request body is over its size limit"},
+	{"RATE_LIMITED", "A rate limit was exceeded; retryAfterMs says when to retry"},
+	{"SHUTTING_DOWN", "The node is shutting down and no longer sends messages"},
+	{"BINARY_NOT_NEGOTIATED", "A binary frame arrived without the binary subprotocol"},
+	{"NO_ADDRESSES", "The node has no reachable addresses"},
+	{"REPLACE_ERROR", "Replacing the sellers failed"},
+	{"BUYER_ONLY_OPERATION", "The command is only available on buyers"},
+	{"UNKNOWN_COMMAND", "The command type or JSON-RPC method is not recognized"},
+	{"ROLE_NOT_ACTIVE", "The endpoint belongs to the role this node does not run"},
+}
+
+// errorCodeNames returns the codes of errorCodes
+func errorCodeNames() []string {
+	names := make([]string, 0, len(errorCodes))
+	for _, code := range errorCodes {
+		names = append(names, code.Code)
+	}
+	return names
+}
+
+// schemaBuilder derives JSON Schemas from Go types, following their json tags. Named struct types are
+// collected once under components/schemas and referenced from everywhere else.
+type schemaBuilder struct {
+	schemas map[string]interface{}
+}
+
+func newSchemaBuilder() *schemaBuilder {
+	return &schemaBuilder{schemas: make(map[string]interface{})}
+}
+
+// schemaOf returns the schema of the type of v
+func (s *schemaBuilder) schemaOf(v interface{}) map[string]interface{} {
+	return s.schema(reflect.TypeOf(v))
+}
+
+// schema returns the schema of t; nil and interface types accept any value
+func (s *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	switch t {
+	case reflect.TypeOf(json.RawMessage{}):
+		return map[string]interface{}{}
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.schema(t.Elem())
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return s.structSchema(t)
+		}
+		if _, exists := s.schemas[name]; !exists {
+			s.schemas[name] = map[string]interface{}{} // placeholder, so a recursive type does not loop
+			s.schemas[name] = s.structSchema(t)
+		}
+		return ref(name)
+	default:
+		return map[string]interface{}{}
+	}
+}
+
+// structSchema lists the exported fields of a struct as properties. Fields without omitempty are required.
+func (s *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = s.schema(field.Type)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// ref points at a schema collected under components/schemas
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// wsMessageSchema is the schema of a WSMessage of one type sent by the node, with data of the given shape.
+// A nil data leaves the data field unconstrained.
+func (s *schemaBuilder) wsMessageSchema(msgType string, data interface{}, required ...string) map[string]interface{} {
+	properties := map[string]interface{}{
+		"type": map[string]interface{}{"const": msgType},
+	}
+	if data != nil {
+		properties["data"] = s.schemaOf(data)
+	}
+	if msgType == "error" {
+		properties["error"] = map[string]interface{}{"type": "string", "enum": errorCodeNames()}
+		required = append(required, "error")
+	}
+	refined := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		refined["required"] = required
+	}
+	return map[string]interface{}{"allOf": []interface{}{s.schemaOf(WSMessage{}), refined}}
+}
+
+// clientMessageSchema is the schema of a WSMessage of one type sent by a client. Unlike the messages the node
+// sends, only type and the listed fields are required.
+func (s *schemaBuilder) clientMessageSchema(msgType string, data interface{}, required ...string) map[string]interface{} {
+	s.schemaOf(WSMessage{})
+	properties := map[string]interface{}{}
+	for name, property := range s.schemas["WSMessage"].(map[string]interface{})["properties"].(map[string]interface{}) {
+		properties[name] = property
+	}
+	properties["type"] = map[string]interface{}{"const": msgType}
+	if data != nil {
+		properties["data"] = s.schemaOf(data)
+	}
+	return map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+		"required":   append([]string{"type"}, required...),
+	}
+}
+
+// asyncAPIMessage describes one message of the WebSocket API
+type asyncAPIMessage struct {
+	key     string
+	name    string
+	summary string
+	payload map[string]interface{}
+}
+
+// buildAsyncAPI describes the WebSocket endpoints as an AsyncAPI 2.6 document. In AsyncAPI terms
+// "publish" lists what clients send and "subscribe" what they receive.
+func buildAsyncAPI(host string, secure bool) map[string]interface{} {
+	s := newSchemaBuilder()
+
+	messages := []asyncAPIMessage{
+		{"p2pSend", "p2p", "Send data to the peer named by publicKey (\"*\" for every peer) or to each of publicKeys, on protocol (default --protocol). Any type other than subscribe and unsubscribe is sent.", s.clientMessageSchema("p2p", nil, "data")},
+		{"subscribe", "subscribe", "Receive only broadcast messages matching the filter", s.clientMessageSchema("subscribe", SubscriptionFilter{})},
+		{"unsubscribe", "unsubscribe", "Clear the subscription filter", s.clientMessageSchema("unsubscribe", nil)},
+		{"p2pReceived", "p2p", "Data received from the peer identified by publicKey, on protocol. With --topic-message-type p2p also the messages from the node's Hedera topic, which carry no protocol.", s.wsMessageSchema("p2p", "")},
+		{"session", "session", "First message on every connection, with the session token for resuming", s.wsMessageSchema("session", SessionInfo{})},
+		{"gap", "gap", "Messages a resumed session missed that could not be replayed", s.wsMessageSchema("gap", GapNotice{})},
+		{"lag", "lag", "Messages dropped because the client read too slowly", s.wsMessageSchema("lag", LagReport{})},
+		{"success", "success", "The request succeeded", s.wsMessageSchema("success", "")},
+		{"sendResults", "sendResults", "The outcome for each recipient of a send to several peers", s.wsMessageSchema("sendResults", []SendResult{})},
+		{"error", "error", "The request failed; error holds the code", s.wsMessageSchema("error", "")},
+		{"subscribed", "subscribed", "The subscription filter now in effect", s.wsMessageSchema("subscribed", SubscriptionFilter{})},
+		{"showCurrentPeers", "showCurrentPeers", "List the peers of this node", s.clientMessageSchema("showCurrentPeers", nil)},
+		{"showSelfInfo", "showSelfInfo", "Report this node's identity, role, protocol ID and addresses", s.clientMessageSchema("showSelfInfo", nil)},
+		{"replaceSellers", "replaceSellers", "Replace the sellers of a buyer; data may also be a string containing the JSON", s.clientMessageSchema("replaceSellers", ReplaceSellersRequest{}, "data")},
+		{"currentPeers", "currentPeers", "The peers of this node with their connection status", s.wsMessageSchema("currentPeers", []types.PeerStatusInfo{})},
+		{"selfInfo", "selfInfo", "This node's identity, role, protocol ID and addresses", s.wsMessageSchema("selfInfo", SelfInfo{})},
+		{"rpcRequest", "rpcRequest", "A JSON-RPC 2.0 request: p2p.send, peers.list, node.info, sellers.replace, subscribe or unsubscribe", s.schemaOf(RPCRequest{})},
+		{"rpcResponse", "rpcResponse", "The JSON-RPC 2.0 response to a request with an id", s.schemaOf(RPCResponse{})},
+		{"rpcNotification", "rpcNotification", "Inbound traffic and session events; the method is the message type", s.schemaOf(RPCNotification{})},
+	}
+	// Topic messages only get their own entry when their type tells them apart from peer messages
+	p2pReceived := []string{"session", "gap", "lag", "p2pReceived", "success", "sendResults", "error", "subscribed"}
+	if *TopicMessageType != "p2p" {
+		messages = append(messages, asyncAPIMessage{"topic", *TopicMessageType, "A message from the node's Hedera topic", s.wsMessageSchema(*TopicMessageType, "")})
+		p2pReceived = append(p2pReceived, "topic")
+	}
+	s.schemaOf(SendRequest{}) // params of p2p.send
+
+	components := map[string]interface{}{}
+	for _, msg := range messages {
+		components[msg.key] = map[string]interface{}{
+			"name":        msg.name,
+			"summary":     msg.summary,
+			"contentType": "application/json",
+			"payload":     msg.payload,
+		}
+	}
+	oneOf := func(keys ...string) map[string]interface{} {
+		refs := make([]interface{}, 0, len(keys))
+		for _, key := range keys {
+			refs = append(refs, map[string]interface{}{"$ref": "#/components/messages/" + key})
+		}
+		return map[string]interface{}{"message": map[string]interface{}{"oneOf": refs}}
+	}
+
+	channels := map[string]interface{}{}
+	for _, role := range []string{"buyer", "seller"} {
+		channels["/"+role+"/p2p"] = map[string]interface{}{
+			"description": "P2P traffic of a " + role + " node, shared by every connected client. Requires --ws-p2p-token when set.",
+			"publish":     oneOf("p2pSend", "subscribe", "unsubscribe"),
+			"subscribe":   oneOf(p2pReceived...),
+		}
+		for _, path := range protocolPaths {
+			channels["/"+role+"/p2p/"+path.Name] = map[string]interface{}{
+				"description": "P2P traffic of a " + role + " node on protocol " + string(path.Protocol) + " only. Requires --ws-p2p-token when set.",
+				"publish":     oneOf("p2pSend", "subscribe", "unsubscribe"),
+				"subscribe":   oneOf("session", "gap", "lag", "p2pReceived", "success", "sendResults", "error", "subscribed"),
+			}
+		}
+		channels["/"+role+"/commands"] = map[string]interface{}{
+			"description": "Internal commands of a " + role + " node. Requires --ws-commands-token when set.",
+			"publish":     oneOf("showCurrentPeers", "showSelfInfo", "replaceSellers"),
+			"subscribe":   oneOf("currentPeers", "selfInfo", "success", "error"),
+		}
+	}
+	channels["/rpc"] = map[string]interface{}{
+		"description": "JSON-RPC 2.0 for the active role. Requires --ws-rpc-token when set.",
+		"publish":     oneOf("rpcRequest"),
+		"subscribe":   oneOf("rpcResponse", "rpcNotification"),
+	}
+
+	protocol := "ws"
+	if secure {
+		protocol = "wss"
+	}
+	return map[string]interface{}{
+		"asyncapi": "2.6.0",
+		"info": map[string]interface{}{
+			"title":       "Neuron SDK WebSocket Wrapper",
+			"version":     AppVersion,
+			"description": "Only the endpoints of the role reported by GET /role accept connections.",
+		},
+		"servers": map[string]interface{}{
+			"node": map[string]interface{}{"url": host, "protocol": protocol},
+		},
+		"defaultContentType": "application/json",
+		"channels":           channels,
+		"components": map[string]interface{}{
+			"messages": components,
+			"schemas":  s.schemas,
+		},
+	}
+}
+
+// openAPIResponses lists the responses of an operation: 200 with the success body, 401 for a missing token,
+// and one response per HTTP status that the given error codes map to
+func openAPIResponses(s *schemaBuilder, success map[string]interface{}, codes ...string) map[string]interface{} {
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Success",
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": success}},
+		},
+		"401": map[string]interface{}{"description": "Missing or invalid token"},
+	}
+	byStatus := map[int][]string{}
+	for _, code := range codes {
+		status := httpStatus(code)
+		byStatus[status] = append(byStatus[status], code)
+	}
+	for status, statusCodes := range byStatus {
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status) + ": " + strings.Join(statusCodes, ", "),
+			"content":     map[string]interface{}{"application/json": map[string]interface{}{"schema": s.wsMessageSchema("error", "")}},
+		}
+	}
+	return responses
+}
+
+// jsonBody is an OpenAPI request body of the given schema
+func jsonBody(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"required": true,
+		"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}},
+	}
+}
+
+// buildOpenAPI describes the plain HTTP endpoints as an OpenAPI 3.1 document
+func buildOpenAPI(host string, secure bool) map[string]interface{} {
+	s := newSchemaBuilder()
+	sendCodes := []string{"PARSE_ERROR", "INVALID_DATA", "MISSING_PUBLIC_KEY", "INVALID_PUBLIC_KEY", "PEER_ID_DECODE_ERROR",
+		"INVALID_PROTOCOL", "PEER_NOT_FOUND", "ROLE_NOT_ACTIVE", "MESSAGE_TOO_LARGE", "RATE_LIMITED", "SEND_ERROR", "SHUTTING_DOWN"}
+
+	paths := map[string]interface{}{
+		"/role": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":   "The role this node runs and the endpoints that accept traffic",
+				"security":  []interface{}{},
+				"responses": map[string]interface{}{"200": map[string]interface{}{"description": "Success", "content": map[string]interface{}{"application/json": map[string]interface{}{"schema": s.schemaOf(RoleInfo{})}}}},
+			},
+		},
+		"/buyer/sellers": map[string]interface{}{
+			"put": map[string]interface{}{
+				"summary":     "Replace the sellers of this buyer (replaceSellers). Requires --ws-commands-token when set.",
+				"requestBody": jsonBody(s.schemaOf(ReplaceSellersRequest{})),
+				"responses":   openAPIResponses(s, s.wsMessageSchema("success", ""), "PARSE_ERROR", "ROLE_NOT_ACTIVE", "MESSAGE_TOO_LARGE", "REPLACE_ERROR", "NO_ADDRESSES"),
+			},
+		},
+	}
+	for _, role := range []string{"buyer", "seller"} {
+		paths["/"+role+"/peers"] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":   "List the peers of this " + role + " (showCurrentPeers). Requires --ws-commands-token when set.",
+				"responses": openAPIResponses(s, s.wsMessageSchema("currentPeers", []types.PeerStatusInfo{}), "ROLE_NOT_ACTIVE"),
+			},
+		}
+		paths["/"+role+"/p2p/send"] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary":     "Send data to a peer, every peer or a list of peers and wait for the result. Requires --ws-p2p-token when set.",
+				"requestBody": jsonBody(s.schemaOf(SendRequest{})),
+				"responses": openAPIResponses(s, map[string]interface{}{
+					"oneOf": []interface{}{s.wsMessageSchema("success", ""), s.wsMessageSchema("sendResults", []SendResult{})},
+				}, sendCodes...),
+			},
+		}
+		paths["/"+role+"/p2p/events"] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "Server-Sent Events stream of the messages a /" + role + "/p2p WebSocket client receives. Requires --ws-p2p-token when set.",
+				"parameters": []interface{}{
+					map[string]interface{}{"name": "Last-Event-ID", "in": "header", "description": "<session>:<seq> of the last event seen, to resume", "schema": map[string]interface{}{"type": "string"}},
+					map[string]interface{}{"name": "lastEventId", "in": "query", "description": "Same as Last-Event-ID, for clients that cannot set headers", "schema": map[string]interface{}{"type": "string"}},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "One event per message, with the JSON message as data and <session>:<seq> as id",
+						"content":     map[string]interface{}{"text/event-stream": map[string]interface{}{"schema": s.schemaOf(WSMessage{})}},
+					},
+					"400": map[string]interface{}{"description": "Malformed Last-Event-ID"},
+					"401": map[string]interface{}{"description": "Missing or invalid token"},
+					"409": map[string]interface{}{"description": "Conflict: ROLE_NOT_ACTIVE"},
+				},
+			},
+		}
+	}
+	for _, doc := range []string{"/asyncapi.json", "/openapi.json"} {
+		paths[doc] = map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":   "This API description",
+				"security":  []interface{}{},
+				"responses": map[string]interface{}{"200": map[string]interface{}{"description": "Success"}},
+			},
+		}
+	}
+
+	scheme := "http"
+	if secure {
+		scheme = "https"
+	}
+	return map[string]interface{}{
+		"openapi": "3.1.0",
+		"info": map[string]interface{}{
+			"title":       "Neuron SDK WebSocket Wrapper",
+			"version":     AppVersion,
+			"description": "Only the endpoints of the role reported by GET /role accept requests. The WebSocket endpoints are described in /asyncapi.json.",
+		},
+		"servers":  []interface{}{map[string]interface{}{"url": scheme + "://" + host}},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}, map[string]interface{}{"queryToken": []string{}}},
+		"paths":    paths,
+		"components": map[string]interface{}{
+			"schemas": s.schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer":     map[string]interface{}{"type": "http", "scheme": "bearer"},
+				"queryToken": map[string]interface{}{"type": "apiKey", "in": "query", "name": "token"},
+			},
+		},
+	}
+}
+
+// serveAPIDocument returns a handler serving a generated API document for the host the request was made to
+func serveAPIDocument(build func(host string, secure bool) map[string]interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(build(r.Host, r.TLS != nil)); err != nil {
+			log.Printf("Error writing API document: %v", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// decodeDocument round-trips a generated API document through JSON, as clients see it
+func decodeDocument(t *testing.T, document map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		t.Fatalf("encoding the document: %v", err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("decoding the document: %v", err)
+	}
+	return decoded
+}
+
+func TestAsyncAPIMessageNames(t *testing.T) {
+	defer func(messageType string) { *TopicMessageType = messageType }(*TopicMessageType)
+
+	tests := []struct {
+		topicMessageType string
+		topicMessage     bool
+	}{
+		{"p2p", false},
+		{"topic", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.topicMessageType, func(t *testing.T) {
+			*TopicMessageType = tt.topicMessageType
+			document := decodeDocument(t, buildAsyncAPI("localhost:3002", false))
+
+			messages := document["components"].(map[string]interface{})["messages"].(map[string]interface{})
+			if _, exists := messages["topic"]; exists != tt.topicMessage {
+				t.Errorf("topic message listed: %t, want %t", exists, tt.topicMessage)
+			}
+
+			channels := document["channels"].(map[string]interface{})
+			for _, name := range []string{"/buyer/p2p", "/seller/p2p", "/buyer/commands", "/seller/commands", "/rpc"} {
+				if _, exists := channels[name]; !exists {
+					t.Errorf("channel %s missing", name)
+				}
+			}
+			for channelName, channel := range channels {
+				for _, operation := range []string{"publish", "subscribe"} {
+					refs := channel.(map[string]interface{})[operation].(map[string]interface{})["message"].(map[string]interface{})["oneOf"].([]interface{})
+					seen := map[string]string{}
+					for _, ref := range refs {
+						key := ref.(map[string]interface{})["$ref"].(string)[len("#/components/messages/"):]
+						message, exists := messages[key].(map[string]interface{})
+						if !exists {
+							t.Errorf("%s %s refers to missing message %s", channelName, operation, key)
+							continue
+						}
+						name := message["name"].(string)
+						if other, clash := seen[name]; clash {
+							t.Errorf("%s %s has messages %s and %s both named %q", channelName, operation, other, key, name)
+						}
+						seen[name] = key
+					}
+				}
+			}
+
+			subscribe := channels["/buyer/p2p"].(map[string]interface{})["subscribe"].(map[string]interface{})["message"].(map[string]interface{})["oneOf"].([]interface{})
+			listed := false
+			for _, ref := range subscribe {
+				if ref.(map[string]interface{})["$ref"] == "#/components/messages/topic" {
+					listed = true
+				}
+			}
+			if listed != tt.topicMessage {
+				t.Errorf("/buyer/p2p subscribe lists the topic message: %t, want %t", listed, tt.topicMessage)
+			}
+		})
+	}
+}
+
+func TestOpenAPIPaths(t *testing.T) {
+	document := decodeDocument(t, buildOpenAPI("localhost:3002", false))
+
+	paths := document["paths"].(map[string]interface{})
+	tests := []struct {
+		path   string
+		method string
+	}{
+		{"/role", "get"},
+		{"/buyer/sellers", "put"},
+		{"/buyer/peers", "get"},
+		{"/seller/peers", "get"},
+		{"/buyer/p2p/send", "post"},
+		{"/seller/p2p/send", "post"},
+		{"/buyer/p2p/events", "get"},
+		{"/seller/p2p/events", "get"},
+		{"/asyncapi.json", "get"},
+		{"/openapi.json", "get"},
+	}
+	for _, tt := range tests {
+		path, exists := paths[tt.path].(map[string]interface{})
+		if !exists {
+			t.Errorf("path %s missing", tt.path)
+			continue
+		}
+		if _, exists := path[tt.method]; !exists {
+			t.Errorf("path %s has no %s operation", tt.path, tt.method)
+		}
+	}
+
+	responses := paths["/buyer/p2p/send"].(map[string]interface{})["post"].(map[string]interface{})["responses"].(map[string]interface{})
+	for _, status := range []string{"200", "400", "401", "404", "413", "429", "502", "503"} {
+		if _, exists := responses[status]; !exists {
+			t.Errorf("POST /buyer/p2p/send has no %s response", status)
+		}
+	}
+}
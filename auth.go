@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// checkOrigin is the CheckOrigin function of every WebSocket upgrader. Requests without an Origin header come
+// from non-browser clients and are allowed; browser requests must match --ws-allowed-origins. An empty list
+// allows every origin, which is only meant for development.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(*WSAllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range *WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+	log.Printf("Rejected WebSocket connection from %s: origin %q is not allowed", r.RemoteAddr, origin)
+	return false
+}
+
+// requestToken returns the token presented with a request, either as "Authorization: Bearer <token>"
+// or as the "token" query parameter (browsers cannot set headers on WebSocket connections)
+func requestToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if scheme, token, ok := strings.Cut(header, " "); ok && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// requireToken wraps a handler so that it only runs when the request presents the expected token.
+// An empty expected token disables the check.
+func requireToken(expected *string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *expected != "" && subtle.ConstantTimeCompare([]byte(requestToken(r)), []byte(*expected)) != 1 {
+			log.Printf("Rejected request from %s to %s: missing or invalid token", r.RemoteAddr, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="neuron-wrapper"`)
+			http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// BinarySubprotocol is the WebSocket subprotocol that switches a P2P connection to binary mode.
+//
+// In binary mode P2P payloads travel as binary frames, byte-exact in both directions. Each frame is
+//
+//	[1 byte key length N][N bytes raw public key][payload]
+//
+// where the public key is the target peer when sending and the sender when receiving (N is 0 when the
+// sender is unknown). Text frames keep carrying JSON WSMessages, so subscriptions, replies and topic
+// messages work exactly as in the default mode.
+const BinarySubprotocol = "nrn-binary.v1"
+
+// encodeBinaryFrame builds a binary frame for a payload exchanged with the peer that has the given hex public key
+func encodeBinaryFrame(publicKey string, payload []byte) ([]byte, error) {
+	key, err := hex.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %q: %w", publicKey, err)
+	}
+	if len(key) > 255 {
+		return nil, fmt.Errorf("public key is %d bytes, at most 255 fit in a binary frame header", len(key))
+	}
+	frame := make([]byte, 0, 1+len(key)+len(payload))
+	frame = append(frame, byte(len(key)))
+	frame = append(frame, key...)
+	return append(frame, payload...), nil
+}
+
+// decodeBinaryFrame turns a binary frame from a client into a p2p WSMessage
+func decodeBinaryFrame(frame []byte) (WSMessage, error) {
+	if len(frame) == 0 {
+		return WSMessage{}, fmt.Errorf("empty binary frame")
+	}
+	keyLen := int(frame[0])
+	if len(frame) < 1+keyLen {
+		return WSMessage{}, fmt.Errorf("binary frame of %d bytes is too short for a %d byte public key", len(frame), keyLen)
+	}
+	return WSMessage{
+		Type:      "p2p",
+		Timestamp: time.Now().UnixMilli(),
+		PublicKey: hex.EncodeToString(frame[1 : 1+keyLen]),
+		Raw:       frame[1+keyLen:],
+	}, nil
+}
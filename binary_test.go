@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBinaryFrame(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     []byte
+		publicKey string
+		payload   []byte
+		wantErr   bool
+	}{
+		{"key and payload", []byte{2, 0xab, 0xcd, 'h', 'i'}, "abcd", []byte("hi"), false},
+		{"key only", []byte{2, 0xab, 0xcd}, "abcd", []byte{}, false},
+		{"no key", []byte{0, 0xff, 0x00}, "", []byte{0xff, 0x00}, false},
+		{"empty frame", nil, "", nil, true},
+		{"truncated key", []byte{3, 0xab, 0xcd}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := decodeBinaryFrame(tt.frame)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if msg.Type != "p2p" || msg.PublicKey != tt.publicKey || !bytes.Equal(msg.Raw, tt.payload) {
+				t.Errorf("decoded %q with key %q and payload %v, want p2p with key %q and payload %v", msg.Type, msg.PublicKey, msg.Raw, tt.publicKey, tt.payload)
+			}
+		})
+	}
+}
+
+func TestEncodeBinaryFrame(t *testing.T) {
+	tests := []struct {
+		name      string
+		publicKey string
+		payload   []byte
+		wantErr   bool
+	}{
+		{"compressed secp256k1 key", "02c7370bf416ee6e9f9a430a12869c456d93db6b7392a9f90d0db8981190f47153", []byte("hello"), false},
+		{"unknown sender", "", []byte{0, 1, 2}, false},
+		{"empty payload", "abcd", nil, false},
+		{"largest key", strings.Repeat("ab", 255), []byte("x"), false},
+		{"key too long", strings.Repeat("ab", 256), []byte("x"), true},
+		{"not hex", "xyz", []byte("x"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := encodeBinaryFrame(tt.publicKey, tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			msg, err := decodeBinaryFrame(frame)
+			if err != nil {
+				t.Fatalf("decoding the encoded frame: %v", err)
+			}
+			if msg.PublicKey != tt.publicKey || !bytes.Equal(msg.Raw, tt.payload) {
+				t.Errorf("round trip gave key %q and payload %v, want %q and %v", msg.PublicKey, msg.Raw, tt.publicKey, tt.payload)
+			}
+		})
+	}
+}
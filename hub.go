@@ -0,0 +1,609 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"golang.org/x/time/rate"
+)
+
+// SlowConsumerPolicy decides what happens when a client's outbound queue is full
+type SlowConsumerPolicy string
+
+const (
+	PolicyBlock      SlowConsumerPolicy = "block"       // wait for room, applying back-pressure to the sender
+	PolicyDropOldest SlowConsumerPolicy = "drop-oldest" // discard the oldest queued message to make room
+	PolicyDropNewest SlowConsumerPolicy = "drop-newest" // discard the message being queued
+	PolicyDisconnect SlowConsumerPolicy = "disconnect"  // close the connection with CloseTryAgainLater
+)
+
+// ParseSlowConsumerPolicy validates a policy name given on the command line
+func ParseSlowConsumerPolicy(name string) (SlowConsumerPolicy, error) {
+	switch policy := SlowConsumerPolicy(name); policy {
+	case PolicyBlock, PolicyDropOldest, PolicyDropNewest, PolicyDisconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown slow consumer policy %q (want block, drop-oldest, drop-newest or disconnect)", name)
+	}
+}
+
+// ClientConn is the transport a Client writes to: a WebSocket connection (wsConn) or a Server-Sent Events stream (sseConn)
+type ClientConn interface {
+	WriteJSON(v interface{}) error
+	WriteMessage(messageType int, data []byte) error
+	RemoteAddr() net.Addr
+	Subprotocol() string
+	setCloseReason(reason string)
+	closeWith(code int, reason string)
+}
+
+// Client is a single connection attached to a Session of a Hub
+type Client struct {
+	hub       *Hub
+	session   *Session
+	conn      ClientConn
+	send      chan WSMessage
+	pending   []WSMessage // session notice and replayed messages, written before anything in send
+	done      chan struct{}
+	closeOnce sync.Once
+	binary    bool          // client negotiated BinarySubprotocol
+	rpc       bool          // client speaks JSON-RPC 2.0 (/rpc endpoint)
+	protocol  protocol.ID   // set on a --protocol-paths endpoint: the only protocol the client sends and receives on
+	sendLimit *rate.Limiter // per-client limit on P2P sends, nil when unlimited
+	dropped   atomic.Uint64 // messages dropped for this client since it attached
+	reported  uint64        // value of dropped at the last lag report, only touched by the write loop
+
+	responsesMu    sync.Mutex
+	responses      []WSMessage   // replies that bypass the send queue, see respond
+	responsesReady chan struct{} // signalled when responses has messages
+}
+
+// ClientMessage is a message read from a WebSocket client, tagged with the client so replies can be routed back to it
+type ClientMessage struct {
+	Client  *Client
+	Message WSMessage
+	Respond func(WSMessage) // when set, replies go here instead of to Client, e.g. for JSON-RPC requests and commands
+}
+
+// Reply sends a response to the client that sent the message, tagged with the message's correlation ID
+func (m ClientMessage) Reply(response WSMessage) {
+	response = replyTo(m.Message, response)
+	if m.Respond != nil {
+		m.Respond(response)
+		return
+	}
+	m.Client.Send(response)
+}
+
+// LagReport is the data of a "lag" message, telling a client how many messages it missed
+type LagReport struct {
+	Dropped      uint64             `json:"dropped"`      // messages dropped since the previous lag report
+	TotalDropped uint64             `json:"totalDropped"` // messages dropped since the client attached
+	Policy       SlowConsumerPolicy `json:"policy"`
+}
+
+// SessionInfo is the data of the "session" message every client receives first after connecting
+type SessionInfo struct {
+	Token   string `json:"token"`   // present this as ?session= when reconnecting
+	Resumed bool   `json:"resumed"` // false when a new session was started
+	LastSeq uint64 `json:"lastSeq"` // highest sequence number assigned so far in this session
+}
+
+// GapNotice is the data of a "gap" message: the inclusive range of sequence numbers that were
+// evicted from the replay buffer before the client came back
+type GapNotice struct {
+	From uint64 `json:"from"`
+	To   uint64 `json:"to"`
+}
+
+// Send queues a reply for this client only. Replies are subject to the type list of the client's subscription.
+// They answer this connection, so they bypass the send queue and the slow consumer policy (see respond) and are
+// neither sequenced nor kept for replay.
+func (c *Client) Send(msg WSMessage) {
+	if !c.session.filter.Load().AllowsType(msg.Type) {
+		return
+	}
+	c.deliver(msg)
+}
+
+// SetFilter replaces the subscription filter of the client's session. A nil filter receives every broadcast message.
+func (c *Client) SetFilter(filter *SubscriptionFilter) {
+	c.session.filter.Store(c.pinnedFilter(filter))
+}
+
+// pinnedFilter restricts a filter to the client's protocol when it is connected to a --protocol-paths endpoint
+func (c *Client) pinnedFilter(filter *SubscriptionFilter) *SubscriptionFilter {
+	if c.protocol == "" {
+		return filter
+	}
+	pinned := SubscriptionFilter{}
+	if filter != nil {
+		pinned = *filter
+	}
+	pinned.Protocols = []string{string(c.protocol)}
+	return &pinned
+}
+
+// deliver queues a reply for this client regardless of its subscription, see Send
+func (c *Client) deliver(msg WSMessage) {
+	msg.Session = c.session.token
+	c.respond(msg)
+}
+
+// respond queues a reply that must reach the client, such as the answer to a request. It bypasses the send queue,
+// so the slow consumer policy never drops it, waits for room for it or disconnects the client for it. The queue has no bound, but it only
+// grows while the write loop is busy writing, which the write timeout limits.
+func (c *Client) respond(msg WSMessage) {
+	select {
+	case <-c.done:
+		return // nothing writes them any more
+	default:
+	}
+	c.responsesMu.Lock()
+	c.responses = append(c.responses, msg)
+	c.responsesMu.Unlock()
+	select {
+	case c.responsesReady <- struct{}{}:
+	default:
+	}
+}
+
+// writeResponses writes the replies queued by respond
+func (c *Client) writeResponses() error {
+	c.responsesMu.Lock()
+	responses := c.responses
+	c.responses = nil
+	c.responsesMu.Unlock()
+	for _, msg := range responses {
+		if err := c.write(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue puts an already sequenced message on the client's queue, applying the hub's
+// slow consumer policy when the queue is full
+func (c *Client) enqueue(msg WSMessage) {
+	select {
+	case <-c.done:
+		return
+	case c.send <- msg:
+		return
+	default:
+	}
+
+	switch c.hub.policy {
+	case PolicyBlock:
+		select {
+		case <-c.done:
+		case c.send <- msg:
+		}
+	case PolicyDropOldest:
+		for {
+			select {
+			case <-c.send:
+				c.dropped.Add(1)
+			default:
+			}
+			select {
+			case c.send <- msg:
+				return
+			case <-c.done:
+				return
+			default:
+				// another sender took the free slot, evict again
+			}
+		}
+	case PolicyDisconnect:
+		c.dropped.Add(1)
+		log.Printf("Disconnecting slow %s client %s: send queue full", c.hub.name, c.conn.RemoteAddr())
+		c.closeWith(websocket.CloseTryAgainLater, "slow consumer: send queue full")
+	default: // PolicyDropNewest
+		c.dropped.Add(1)
+	}
+}
+
+// closeWith sends a close frame to the client and stops its write loop. Safe to call more than once.
+func (c *Client) closeWith(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.conn.setCloseReason(reason)
+		close(c.done)
+		go c.conn.closeWith(code, reason)
+	})
+}
+
+// writePump writes the pending session messages and then queued messages to the connection until the client
+// is closed, the reader stops or a write fails. When messages have been dropped, a "lag" message is written
+// after the next successful write.
+func (c *Client) writePump(readerDone <-chan struct{}) {
+	for _, msg := range c.pending {
+		if err := c.write(msg); err != nil {
+			log.Printf("Error writing message: %v", err)
+			return
+		}
+	}
+	c.pending = nil
+
+	for {
+		select {
+		case <-readerDone:
+			return
+		case <-c.done:
+			return
+		case <-c.responsesReady:
+			if err := c.writeResponses(); err != nil {
+				log.Printf("Error writing response: %v", err)
+				return
+			}
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				log.Printf("Error writing message: %v", err)
+				return
+			}
+			if err := c.reportLag(); err != nil {
+				log.Printf("Error writing lag report: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// write sends one message to the client. In binary mode raw P2P payloads go out as binary frames, everything else as JSON.
+// JSON-RPC clients get responses as they are and every other message as a notification.
+func (c *Client) write(msg WSMessage) error {
+	if c.rpc {
+		return c.conn.WriteJSON(rpcFrame(msg))
+	}
+	if c.binary && msg.Type == "p2p" && msg.Raw != nil {
+		frame, err := encodeBinaryFrame(msg.PublicKey, msg.Raw)
+		if err == nil {
+			return c.conn.WriteMessage(websocket.BinaryMessage, frame)
+		}
+		log.Printf("Cannot encode binary frame for %s client %s, falling back to JSON: %v", c.hub.name, c.conn.RemoteAddr(), err)
+	}
+	return c.conn.WriteJSON(msg)
+}
+
+// reportLag tells the client how many messages it has missed since the last report, if any
+func (c *Client) reportLag() error {
+	total := c.dropped.Load()
+	if total == c.reported {
+		return nil
+	}
+	report := LagReport{
+		Dropped:      total - c.reported,
+		TotalDropped: total,
+		Policy:       c.hub.policy,
+	}
+	c.reported = total
+	log.Printf("%s client %s lagging: %d messages dropped (%d total)", c.hub.name, c.conn.RemoteAddr(), report.Dropped, report.TotalDropped)
+	return c.write(WSMessage{
+		Type:      "lag",
+		Data:      report,
+		Timestamp: time.Now().UnixMilli(),
+		Session:   c.session.token,
+	})
+}
+
+// replayBuffer is a ring of the most recent messages of a session. Sequence numbers in a session
+// are contiguous, so the buffer always holds the range (nextSeq-count, nextSeq].
+type replayBuffer struct {
+	msgs  []WSMessage
+	start int
+	count int
+}
+
+func newReplayBuffer(size int) replayBuffer {
+	return replayBuffer{msgs: make([]WSMessage, size)}
+}
+
+// push appends a message, evicting the oldest one when the buffer is full
+func (r *replayBuffer) push(msg WSMessage) {
+	if len(r.msgs) == 0 {
+		return
+	}
+	if r.count < len(r.msgs) {
+		r.msgs[(r.start+r.count)%len(r.msgs)] = msg
+		r.count++
+		return
+	}
+	r.msgs[r.start] = msg
+	r.start = (r.start + 1) % len(r.msgs)
+}
+
+// since returns the buffered messages with a sequence number above lastSeq, oldest first
+func (r *replayBuffer) since(lastSeq uint64) []WSMessage {
+	var missed []WSMessage
+	for i := 0; i < r.count; i++ {
+		msg := r.msgs[(r.start+i)%len(r.msgs)]
+		if msg.Seq > lastSeq {
+			missed = append(missed, msg)
+		}
+	}
+	return missed
+}
+
+// Session is the state a WebSocket client keeps across reconnects: its sequence counter, its subscription
+// and a bounded buffer of recent messages that can be replayed after a reconnect. While no client is
+// attached the session keeps buffering, until it expires after the hub's session TTL or is evicted to make room
+// for sessions detached more recently.
+type Session struct {
+	hub        *Hub
+	token      string
+	filter     atomic.Pointer[SubscriptionFilter]
+	current    atomic.Pointer[Client] // attached client, readable without mu so a blocked deliver can be interrupted
+	detachedAt atomic.Int64           // UnixNano of the detach while resumable, 0 while attached
+
+	mu      sync.Mutex
+	nextSeq uint64 // last sequence number assigned
+	replay  replayBuffer
+	expiry  *time.Timer // removes the session once it has been detached for the session TTL
+}
+
+// deliver stamps a message with the session token and the next sequence number, keeps it for replay
+// and queues it for the attached client, if any
+func (s *Session) deliver(msg WSMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextSeq++
+	msg.Seq = s.nextSeq
+	msg.Session = s.token
+	s.replay.push(msg)
+
+	if client := s.current.Load(); client != nil {
+		client.enqueue(msg)
+	}
+}
+
+// Hub keeps track of the WebSocket sessions of one endpoint and fans out messages to all of them
+type Hub struct {
+	name        string
+	queueSize   int
+	policy      SlowConsumerPolicy
+	replaySize  int
+	sessionTTL  time.Duration
+	maxDetached int
+	mu          sync.RWMutex
+	sessions    map[string]*Session
+}
+
+// NewHub creates an empty hub. Each client gets a queue of queueSize messages, handled by policy when full;
+// each session keeps the last replaySize messages and survives a disconnect for sessionTTL. At most maxDetached
+// disconnected sessions are kept (0 for no limit); beyond that the one disconnected longest is dropped.
+// The name is only used for logging.
+func NewHub(name string, queueSize int, policy SlowConsumerPolicy, replaySize int, sessionTTL time.Duration, maxDetached int) *Hub {
+	return &Hub{
+		name:        name,
+		queueSize:   queueSize,
+		policy:      policy,
+		replaySize:  replaySize,
+		sessionTTL:  sessionTTL,
+		maxDetached: maxDetached,
+		sessions:    make(map[string]*Session),
+	}
+}
+
+// Register attaches a new connection to the hub and returns its client. When token names a live
+// session, the connection resumes it: messages after lastSeq are replayed from the session's buffer, preceded
+// by a "gap" notice if some of them were already evicted. Otherwise a new session is started. A non-empty pinned
+// protocol restricts the session's subscription to that protocol, for the --protocol-paths endpoints.
+func (h *Hub) Register(conn ClientConn, token string, lastSeq uint64, pinned protocol.ID) *Client {
+	client := h.newClient(conn)
+	client.protocol = pinned
+
+	h.mu.Lock()
+	session, resumed := h.sessions[token]
+	if !resumed {
+		if token != "" {
+			log.Printf("Session %s of %s hub not found, starting a new one", token, h.name)
+		}
+		session = &Session{
+			hub:    h,
+			token:  newSessionToken(),
+			replay: newReplayBuffer(h.replaySize),
+		}
+		session.filter.Store(client.pinnedFilter(nil))
+	}
+	h.mu.Unlock()
+
+	// A client still attached to the session loses it; close it before taking the lock, since its
+	// deliver may be blocked on a full queue
+	if previous := session.current.Load(); previous != nil {
+		previous.closeWith(websocket.CloseNormalClosure, "session resumed by another connection")
+	}
+
+	session.mu.Lock()
+	if resumed && pinned != "" {
+		session.filter.Store(client.pinnedFilter(session.filter.Load()))
+	}
+	if previous := session.current.Swap(client); previous != nil {
+		previous.closeWith(websocket.CloseNormalClosure, "session resumed by another connection")
+	}
+	if session.expiry != nil {
+		session.expiry.Stop()
+		session.expiry = nil
+	}
+	session.detachedAt.Store(0)
+	// The session may have expired since the lookup above; attaching to it makes it resumable again. Once the
+	// client is current, an expiry that has yet to take session.mu leaves the session alone.
+	h.mu.Lock()
+	h.sessions[session.token] = session
+	count := len(h.sessions)
+	h.mu.Unlock()
+	client.session = session
+	client.pending = append(client.pending, WSMessage{
+		Type:      "session",
+		Data:      SessionInfo{Token: session.token, Resumed: resumed, LastSeq: session.nextSeq},
+		Timestamp: time.Now().UnixMilli(),
+		Session:   session.token,
+	})
+	if resumed && lastSeq < session.nextSeq {
+		oldest := session.nextSeq - uint64(session.replay.count) + 1
+		if lastSeq+1 < oldest {
+			client.pending = append(client.pending, WSMessage{
+				Type:      "gap",
+				Data:      GapNotice{From: lastSeq + 1, To: oldest - 1},
+				Timestamp: time.Now().UnixMilli(),
+				Session:   session.token,
+			})
+		}
+		client.pending = append(client.pending, session.replay.since(lastSeq)...)
+	}
+	session.mu.Unlock()
+
+	log.Printf("Client %s attached to %s hub session %s (resumed: %t, %d sessions, binary mode: %t)", conn.RemoteAddr(), h.name, session.token, resumed, count, client.binary)
+	return client
+}
+
+// RegisterRPC attaches a JSON-RPC connection. JSON-RPC clients cannot resume a session, so theirs keeps no replay
+// buffer, starts without a session notice and is removed as soon as the client unregisters.
+func (h *Hub) RegisterRPC(conn ClientConn) *Client {
+	client := h.newClient(conn)
+	client.rpc = true
+	session := &Session{hub: h, token: newSessionToken()}
+	session.current.Store(client)
+	client.session = session
+
+	h.mu.Lock()
+	h.sessions[session.token] = session
+	count := len(h.sessions)
+	h.mu.Unlock()
+
+	log.Printf("JSON-RPC client %s attached to %s hub (%d sessions)", conn.RemoteAddr(), h.name, count)
+	return client
+}
+
+// newClient creates the client of a new connection, not yet attached to a session
+func (h *Hub) newClient(conn ClientConn) *Client {
+	return &Client{
+		hub:            h,
+		conn:           conn,
+		send:           make(chan WSMessage, h.queueSize),
+		done:           make(chan struct{}),
+		binary:         conn.Subprotocol() == BinarySubprotocol,
+		responsesReady: make(chan struct{}, 1),
+	}
+}
+
+// Unregister detaches a client from its session. Its done channel is closed first so that a delivery
+// blocked on the client's full queue (block policy) is released. The session is kept for the session TTL
+// so the client can resume it, except for JSON-RPC clients, which cannot.
+func (h *Hub) Unregister(client *Client) {
+	client.closeOnce.Do(func() { close(client.done) })
+
+	session := client.session
+	session.mu.Lock()
+	if !session.current.CompareAndSwap(client, nil) {
+		session.mu.Unlock()
+		return // another connection has resumed the session
+	}
+
+	log.Printf("Client %s detached from %s hub session %s (%d messages dropped)", client.conn.RemoteAddr(), h.name, session.token, client.dropped.Load())
+	if h.sessionTTL <= 0 || client.rpc {
+		h.removeSession(session, "closed")
+		session.mu.Unlock()
+		return
+	}
+	session.detachedAt.Store(time.Now().UnixNano())
+	session.expiry = time.AfterFunc(h.sessionTTL, func() {
+		session.mu.Lock()
+		defer session.mu.Unlock()
+		if session.current.Load() == nil {
+			h.removeSession(session, "expired")
+		}
+	})
+	session.mu.Unlock()
+
+	h.evictDetached()
+}
+
+// evictDetached drops the sessions that have been detached the longest while more than maxDetached are waiting
+// to be resumed, so clients that keep reconnecting cannot pile up replay buffers
+func (h *Hub) evictDetached() {
+	if h.maxDetached <= 0 {
+		return
+	}
+	type detached struct {
+		session *Session
+		since   int64
+	}
+	var candidates []detached
+	h.mu.RLock()
+	for _, session := range h.sessions {
+		if since := session.detachedAt.Load(); since != 0 {
+			candidates = append(candidates, detached{session, since})
+		}
+	}
+	h.mu.RUnlock()
+	if len(candidates) <= h.maxDetached {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].since < candidates[j].since })
+	for _, candidate := range candidates[:len(candidates)-h.maxDetached] {
+		session := candidate.session
+		session.mu.Lock()
+		if session.current.Load() == nil && session.detachedAt.Load() != 0 { // not resumed in the meantime
+			if session.expiry != nil {
+				session.expiry.Stop()
+				session.expiry = nil
+			}
+			session.detachedAt.Store(0)
+			h.removeSession(session, fmt.Sprintf("evicted, over %d disconnected sessions", h.maxDetached))
+		}
+		session.mu.Unlock()
+	}
+}
+
+// removeSession forgets a session. The caller holds the session's lock.
+func (h *Hub) removeSession(session *Session, reason string) {
+	h.mu.Lock()
+	delete(h.sessions, session.token)
+	count := len(h.sessions)
+	h.mu.Unlock()
+	log.Printf("Session %s of %s hub %s (%d sessions)", session.token, h.name, reason, count)
+}
+
+// Broadcast delivers a message to every session whose subscription matches it; detached sessions buffer it
+// for replay. If there are no sessions at all the message is dropped. A client whose queue is full is handled
+// by the hub's slow consumer policy, so only the block policy can hold up the caller.
+func (h *Hub) Broadcast(msg WSMessage) {
+	h.mu.RLock()
+	sessions := make([]*Session, 0, len(h.sessions))
+	for _, session := range h.sessions {
+		sessions = append(sessions, session)
+	}
+	h.mu.RUnlock()
+
+	if len(sessions) == 0 {
+		log.Printf("No clients attached to %s hub, dropping %s message", h.name, msg.Type)
+		return
+	}
+
+	for _, session := range sessions {
+		if !session.filter.Load().Matches(msg) {
+			continue
+		}
+		session.deliver(msg)
+	}
+}
+
+// newSessionToken returns a random token identifying a session
+func newSessionToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		log.Panicf("Cannot generate session token: %v", err)
+	}
+	return hex.EncodeToString(token)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testConn is a ClientConn that writes nowhere
+type testConn struct {
+	subprotocol string
+}
+
+func (testConn) WriteJSON(v interface{}) error                   { return nil }
+func (testConn) WriteMessage(messageType int, data []byte) error { return nil }
+func (testConn) RemoteAddr() net.Addr                            { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c testConn) Subprotocol() string                           { return c.subprotocol }
+func (testConn) setCloseReason(reason string)                    {}
+func (testConn) closeWith(code int, reason string)               {}
+
+// seqs returns the sequence numbers of the messages
+func seqs(msgs []WSMessage) []uint64 {
+	numbers := []uint64{}
+	for _, msg := range msgs {
+		numbers = append(numbers, msg.Seq)
+	}
+	return numbers
+}
+
+func TestReplayBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		pushed  int
+		lastSeq uint64
+		want    []uint64
+	}{
+		{"disabled", 0, 3, 0, []uint64{}},
+		{"not full", 3, 2, 0, []uint64{1, 2}},
+		{"full", 3, 3, 0, []uint64{1, 2, 3}},
+		{"oldest evicted", 3, 5, 0, []uint64{3, 4, 5}},
+		{"since the middle", 3, 5, 3, []uint64{4, 5}},
+		{"nothing missed", 3, 5, 5, []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := newReplayBuffer(tt.size)
+			for seq := 1; seq <= tt.pushed; seq++ {
+				buffer.push(WSMessage{Type: "p2p", Seq: uint64(seq)})
+			}
+			if got := seqs(buffer.since(tt.lastSeq)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("since(%d) = %v, want %v", tt.lastSeq, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterResume(t *testing.T) {
+	tests := []struct {
+		name       string
+		replaySize int
+		sessionTTL time.Duration
+		sent       int
+		token      string // "" resumes the first session
+		lastSeq    uint64
+		resumed    bool
+		gap        *GapNotice
+		replayed   []uint64
+	}{
+		{"nothing missed", 4, time.Minute, 3, "", 3, true, nil, []uint64{}},
+		{"missed messages replayed", 4, time.Minute, 3, "", 1, true, nil, []uint64{2, 3}},
+		{"evicted messages reported", 2, time.Minute, 5, "", 1, true, &GapNotice{From: 2, To: 3}, []uint64{4, 5}},
+		{"no replay buffer", 0, time.Minute, 3, "", 0, true, &GapNotice{From: 1, To: 3}, []uint64{}},
+		{"unknown session", 4, time.Minute, 3, "unknown", 1, false, nil, []uint64{}},
+		{"session expired at once", 4, 0, 3, "", 1, false, nil, []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub("test", 16, PolicyDropNewest, tt.replaySize, tt.sessionTTL, 0)
+			first := hub.Register(testConn{}, "", 0, "")
+			for i := 0; i < tt.sent; i++ {
+				hub.Broadcast(WSMessage{Type: "p2p", Data: "message"})
+			}
+			hub.Unregister(first)
+
+			token := tt.token
+			if token == "" {
+				token = first.session.token
+			}
+			client := hub.Register(testConn{}, token, tt.lastSeq, "")
+			defer hub.Unregister(client)
+
+			pending := client.pending
+			if len(pending) == 0 || pending[0].Type != "session" {
+				t.Fatalf("first pending message is not the session notice: %+v", pending)
+			}
+			info := pending[0].Data.(SessionInfo)
+			if info.Resumed != tt.resumed {
+				t.Errorf("resumed = %t, want %t", info.Resumed, tt.resumed)
+			}
+			if tt.resumed && (info.Token != first.session.token || info.LastSeq != uint64(tt.sent)) {
+				t.Errorf("session notice = %+v, want token %s and last seq %d", info, first.session.token, tt.sent)
+			}
+			pending = pending[1:]
+
+			if tt.gap != nil {
+				if len(pending) == 0 || pending[0].Type != "gap" {
+					t.Fatalf("no gap notice in %+v", pending)
+				}
+				if gap := pending[0].Data.(GapNotice); gap != *tt.gap {
+					t.Errorf("gap = %+v, want %+v", gap, *tt.gap)
+				}
+				pending = pending[1:]
+			}
+			if got := seqs(pending); !reflect.DeepEqual(got, tt.replayed) {
+				t.Errorf("replayed %v, want %v", got, tt.replayed)
+			}
+		})
+	}
+}
+
+func TestEvictOldestDetachedSession(t *testing.T) {
+	hub := NewHub("test", 16, PolicyDropNewest, 4, time.Minute, 2)
+	var tokens []string
+	for i := 0; i < 3; i++ {
+		client := hub.Register(testConn{}, "", 0, "")
+		tokens = append(tokens, client.session.token)
+		hub.Unregister(client)
+	}
+
+	hub.mu.RLock()
+	_, oldest := hub.sessions[tokens[0]]
+	count := len(hub.sessions)
+	hub.mu.RUnlock()
+	if oldest {
+		t.Error("session detached longest was kept")
+	}
+	if count != 2 {
+		t.Errorf("%d sessions kept, want 2", count)
+	}
+
+	client := hub.Register(testConn{}, tokens[1], 0, "")
+	defer hub.Unregister(client)
+	if info := client.pending[0].Data.(SessionInfo); !info.Resumed {
+		t.Error("newer detached session was not resumable")
+	}
+}
+
+func TestRepliesBypassSlowConsumerPolicy(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{PolicyDropOldest, PolicyDropNewest, PolicyDisconnect} {
+		t.Run(string(policy), func(t *testing.T) {
+			hub := NewHub("test", 1, policy, 4, time.Minute, 0)
+			client := hub.Register(testConn{}, "", 0, "")
+			defer hub.Unregister(client)
+
+			// With the queue full, a reply would be dropped or get the client disconnected if it were queued
+			hub.Broadcast(WSMessage{Type: "p2p", Data: "fills the queue"})
+			ClientMessage{Client: client, Message: WSMessage{ID: "req-1"}}.Reply(WSMessage{Type: "success", Data: "sent"})
+
+			select {
+			case <-client.done:
+				t.Fatal("client was disconnected")
+			default:
+			}
+			if dropped := client.dropped.Load(); dropped != 0 {
+				t.Errorf("%d messages dropped", dropped)
+			}
+			if queued := <-client.send; queued.Data != "fills the queue" {
+				t.Errorf("queued %+v, want the broadcast", queued)
+			}
+			if len(client.responses) != 1 || client.responses[0].ID != "req-1" || client.responses[0].Seq != 0 {
+				t.Errorf("responses = %+v, want the unsequenced reply to req-1", client.responses)
+			}
+		})
+	}
+}
+
+func TestReplyDoesNotBlockOnFullQueue(t *testing.T) {
+	hub := NewHub("test", 1, PolicyBlock, 4, time.Minute, 0)
+	client := hub.Register(testConn{}, "", 0, "")
+	defer hub.Unregister(client)
+	hub.Broadcast(WSMessage{Type: "p2p", Data: "fills the queue"})
+
+	// The P2P send loop replies to every client in turn; a client that does not read must not hold it up
+	replied := make(chan struct{})
+	go func() {
+		defer close(replied)
+		for i := 0; i < 10; i++ {
+			ClientMessage{Client: client}.Reply(WSMessage{Type: "success", Data: "sent"})
+		}
+	}()
+	select {
+	case <-replied:
+	case <-time.After(time.Second):
+		t.Fatal("Reply blocked on the client's full queue")
+	}
+	if len(client.responses) != 10 {
+		t.Errorf("%d replies queued, want 10", len(client.responses))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// parseListenAddress splits a --listen value into a network and an address. Accepted forms are
+// unix:///path/to/socket and tcp://host:port (host may be empty to bind all interfaces).
+func parseListenAddress(spec string) (string, string, error) {
+	parsed, err := url.Parse(spec)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid listen address %q: %w", spec, err)
+	}
+	switch parsed.Scheme {
+	case "unix":
+		if parsed.Path == "" {
+			return "", "", fmt.Errorf("invalid listen address %q: want unix:///path/to/socket", spec)
+		}
+		return "unix", parsed.Path, nil
+	case "tcp":
+		if _, _, err := net.SplitHostPort(parsed.Host); err != nil {
+			return "", "", fmt.Errorf("invalid listen address %q: want tcp://host:port", spec)
+		}
+		return "tcp", parsed.Host, nil
+	default:
+		return "", "", fmt.Errorf("invalid listen address %q: scheme must be unix or tcp", spec)
+	}
+}
+
+// unixSocketProbeTimeout bounds the dial that tells a stale socket file from one a running process listens on
+const unixSocketProbeTimeout = time.Second
+
+// openListener opens one --listen address. A stale socket file left behind by a previous run is removed, but a
+// socket another process still listens on is left alone and the listener is refused. A new socket gets the
+// permissions from --listen-unix-mode so access is controlled by the file system.
+func openListener(spec string) (net.Listener, error) {
+	network, address, err := parseListenAddress(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		if info, err := os.Lstat(address); err == nil {
+			if info.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("cannot listen on %s: file exists and is not a socket", address)
+			}
+			conn, err := net.DialTimeout("unix", address, unixSocketProbeTimeout)
+			if err == nil {
+				conn.Close()
+				return nil, fmt.Errorf("cannot listen on %s: another process is listening on it", address)
+			}
+			if !errors.Is(err, syscall.ECONNREFUSED) {
+				return nil, fmt.Errorf("cannot listen on %s: cannot tell whether the socket is in use: %w", address, err)
+			}
+			if err := os.Remove(address); err != nil {
+				return nil, fmt.Errorf("removing stale socket %s: %w", address, err)
+			}
+		}
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("listening on %s: %w", spec, err)
+	}
+
+	if network == "unix" {
+		if err := os.Chmod(address, os.FileMode(*ListenUnixMode)); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("setting permissions on %s: %w", address, err)
+		}
+	}
+	return listener, nil
+}
+
+// startServer opens every --listen address (or :--ws-port when none is given) and serves the default mux on
+// all of them. TCP listeners use TLS when tlsConfig is set; Unix sockets are always served in plain text.
+func startServer(tlsConfig *tls.Config) (*http.Server, error) {
+	specs := *Listen
+	if len(specs) == 0 {
+		specs = []string{fmt.Sprintf("tcp://:%d", *WSPort)}
+	}
+
+	server := &http.Server{TLSConfig: tlsConfig}
+	listeners := make([]net.Listener, 0, len(specs))
+	for _, spec := range specs {
+		listener, err := openListener(spec)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, err
+		}
+		if tlsConfig != nil && listener.Addr().Network() == "tcp" {
+			listener = tls.NewListener(listener, tlsConfig)
+			log.Printf("Starting WebSocket server with TLS (wss://) on %s", spec)
+		} else {
+			log.Printf("Starting WebSocket server on %s", spec)
+		}
+		listeners = append(listeners, listener)
+	}
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("Serving on %s: %v", listener.Addr(), err)
+			}
+		}(listener)
+	}
+	return server, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		network string
+		address string
+		wantErr bool
+	}{
+		{"unix socket", "unix:///run/nrn/wrapper.sock", "unix", "/run/nrn/wrapper.sock", false},
+		{"tcp on all interfaces", "tcp://:8080", "tcp", ":8080", false},
+		{"tcp on loopback", "tcp://127.0.0.1:8080", "tcp", "127.0.0.1:8080", false},
+		{"tcp on IPv6", "tcp://[::1]:8080", "tcp", "[::1]:8080", false},
+		{"unix without path", "unix://", "", "", true},
+		{"tcp without port", "tcp://localhost", "", "", true},
+		{"no scheme", "localhost:8080", "", "", true},
+		{"other scheme", "http://localhost:8080", "", "", true},
+		{"not a URL", "tcp://%zz", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, address, err := parseListenAddress(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if network != tt.network || address != tt.address {
+				t.Errorf("parseListenAddress(%q) = %q, %q, want %q, %q", tt.spec, network, address, tt.network, tt.address)
+			}
+		})
+	}
+}
+
+func TestOpenListenerUnixSocket(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, path string)
+		wantErr bool
+	}{
+		{"no file", func(t *testing.T, path string) {}, false},
+		{"stale socket", func(t *testing.T, path string) {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			listener.(*net.UnixListener).SetUnlinkOnClose(false)
+			listener.Close()
+		}, false},
+		{"socket in use", func(t *testing.T, path string) {
+			listener, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { listener.Close() })
+		}, true},
+		{"regular file", func(t *testing.T, path string) {
+			if err := os.WriteFile(path, nil, 0o600); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wrapper.sock")
+			tt.prepare(t, path)
+			listener, err := openListener("unix://" + path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if listener != nil {
+				listener.Close()
+			}
+			if _, err := os.Lstat(path); tt.wantErr && err != nil {
+				t.Errorf("refused listener removed %s: %v", path, err)
+			}
+		})
+	}
+}
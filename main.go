@@ -2,15 +2,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	neuronsdk "github.com/NeuronInnovations/neuron-go-hedera-sdk" // Import neuronFactory from neuron-go-sdk
@@ -28,9 +35,51 @@ import (
 	"github.com/spf13/pflag"
 )
 
+// AppVersion is the version reported to the SDK and in the API documents
+const AppVersion = "0.1"
+
 var (
-	Protocol = protocol.ID(*pflag.String("protocol", "nrn-nodered/v1", "Protocol ID for the neuron network"))
-	WSPort   = pflag.Int("ws-port", 8080, "WebSocket server port")
+	ProtocolFlag      = pflag.String("protocol", "nrn-nodered/v2", "Protocol ID for the neuron network")
+	ProtocolsFlag     = pflag.StringSlice("protocols", nil, "Additional application protocol IDs served next to --protocol over the same connections")
+	ProtocolPathsFlag = pflag.StringToString("protocol-paths", nil, "Dedicated WebSocket endpoints as <name>=<protocol ID>, served at /buyer/p2p/<name> and /seller/p2p/<name>")
+	WSPort            = pflag.Int("ws-port", 8080, "WebSocket server port")
+
+	TopicMessageType = pflag.String("topic-message-type", "p2p", "Message type of Hedera topic messages on the P2P endpoints: p2p as in earlier versions, or topic to tell them apart from peer messages")
+
+	Listen         = pflag.StringArray("listen", nil, "Address to serve the WebSocket and command API on: unix:///path or tcp://host:port (repeatable, overrides --ws-port)")
+	ListenUnixMode = pflag.Uint32("listen-unix-mode", 0660, "File permissions of Unix domain sockets created by --listen")
+
+	WSQueueSize          = pflag.Int("ws-queue-size", 256, "Maximum number of outbound messages queued per WebSocket client")
+	WSSlowConsumerPolicy = pflag.String("ws-slow-consumer-policy", string(PolicyDropNewest), "What to do when a client's queue is full: block, drop-oldest, drop-newest or disconnect")
+
+	WSReplayBuffer = pflag.Int("ws-replay-buffer", 1024, "Number of recent messages kept per session for replay after a reconnect")
+	WSSessionTTL   = pflag.Duration("ws-session-ttl", 2*time.Minute, "How long a disconnected session is kept so the client can resume it")
+	WSMaxSessions  = pflag.Int("ws-max-sessions", 256, "Maximum number of disconnected sessions kept per role; the one disconnected longest is dropped first (0 disables the limit)")
+
+	WSAllowedOrigins = pflag.StringSlice("ws-allowed-origins", nil, "Origins allowed to open WebSocket connections, e.g. https://dashboard.example.com (empty allows all)")
+	WSP2PToken       = pflag.String("ws-p2p-token", os.Getenv("WS_P2P_TOKEN"), "Token required on the /p2p endpoints as a Bearer header or ?token= (defaults to $WS_P2P_TOKEN, empty disables)")
+	WSCommandsToken  = pflag.String("ws-commands-token", os.Getenv("WS_COMMANDS_TOKEN"), "Token required on the /commands endpoints as a Bearer header or ?token= (defaults to $WS_COMMANDS_TOKEN, empty disables)")
+	WSRPCToken       = pflag.String("ws-rpc-token", os.Getenv("WS_RPC_TOKEN"), "Token required on the /rpc endpoint as a Bearer header or ?token= (defaults to $WS_RPC_TOKEN, empty disables)")
+
+	TLSCertFile   = pflag.String("tls-cert", "", "PEM certificate file; serves wss:// when set together with --tls-key (reloaded on SIGHUP)")
+	TLSKeyFile    = pflag.String("tls-key", "", "PEM private key file for --tls-cert")
+	TLSSelfSigned = pflag.Bool("tls-self-signed", false, "Serve a generated self-signed certificate for development (written to --tls-cert/--tls-key if they do not exist)")
+
+	P2PClientRate  = pflag.Float64("p2p-client-rate", 0, "Maximum P2P sends per second per WebSocket client (0 disables)")
+	P2PClientBurst = pflag.Int("p2p-client-burst", 20, "Burst size for --p2p-client-rate")
+	P2PPeerRate    = pflag.Float64("p2p-peer-rate", 0, "Maximum P2P sends per second to a single peer, across all clients (0 disables)")
+	P2PPeerBurst   = pflag.Int("p2p-peer-burst", 20, "Burst size for --p2p-peer-rate")
+
+	WSMaxFrameBytes         = pflag.Int64("ws-max-frame-bytes", 1<<20, "Largest WebSocket message accepted on the /p2p endpoints; larger ones close the connection with code 1009")
+	P2PMaxPayloadBytes      = pflag.Int("p2p-max-payload-bytes", 1<<20, "Largest payload sent to a peer in a single P2P message; larger sends fail with MESSAGE_TOO_LARGE")
+	CommandsMaxPayloadBytes = pflag.Int64("commands-max-payload-bytes", 64<<10, "Largest WebSocket message accepted on the /commands endpoints; larger ones close the connection with code 1009")
+
+	ShutdownTimeout = pflag.Duration("shutdown-timeout", 10*time.Second, "Time allowed on SIGINT/SIGTERM to flush queued sends and close connections before exiting")
+
+	WSPingInterval = pflag.Duration("ws-ping-interval", 30*time.Second, "Interval between WebSocket pings (0 disables pings)")
+	WSPongTimeout  = pflag.Duration("ws-pong-timeout", 60*time.Second, "Close a WebSocket connection when nothing, not even a pong, is read for this long (0 disables)")
+	WSWriteTimeout = pflag.Duration("ws-write-timeout", 10*time.Second, "Deadline for writing a single WebSocket message")
+	WSIdleTimeout  = pflag.Duration("ws-idle-timeout", 0, "Close a WebSocket connection after this long without a client message (0 disables)")
 )
 
 func init() {
@@ -53,11 +102,34 @@ func (w *locationWriter) Write(p []byte) (n int, err error) {
 
 // WebSocket message structure
 type WSMessage struct {
-	Type      string      `json:"type"`
-	Data      interface{} `json:"data"`
-	Timestamp int64       `json:"timestamp"`
-	PublicKey string      `json:"publicKey,omitempty"` // Optional field to specify target peer
-	Error     string      `json:"error,omitempty"`     // Add error field for responses
+	ID           string      `json:"id,omitempty"` // Optional correlation ID, echoed on every reply to this message
+	Type         string      `json:"type"`
+	Data         interface{} `json:"data"`
+	Timestamp    int64       `json:"timestamp"`
+	PublicKey    string      `json:"publicKey,omitempty"`    // Optional field to specify target peer, "*" for every peer
+	PublicKeys   []string    `json:"publicKeys,omitempty"`   // Several target peers, each answered in a sendResults list
+	Protocol     string      `json:"protocol,omitempty"`     // Protocol ID the message arrived on, or to send on (defaults to --protocol)
+	Error        string      `json:"error,omitempty"`        // Add error field for responses
+	RetryAfterMs int64       `json:"retryAfterMs,omitempty"` // Set on RATE_LIMITED errors: how long to wait before retrying
+	Seq          uint64      `json:"seq,omitempty"`          // Per-session sequence number, set on messages sent to P2P clients
+	Session      string      `json:"session,omitempty"`      // Session token, set on messages sent to P2P clients
+	Raw          []byte      `json:"-"`                      // Byte-exact P2P payload, used instead of Data when set
+}
+
+// MarshalJSON writes a Raw payload as the data string when Data is not set, so received P2P messages hold a
+// single copy of their payload however they are delivered
+func (m WSMessage) MarshalJSON() ([]byte, error) {
+	type message WSMessage // without this method
+	if m.Data == nil && m.Raw != nil {
+		m.Data = string(m.Raw)
+	}
+	return json.Marshal(message(m))
+}
+
+// replyTo tags a response with the correlation ID of the request that produced it
+func replyTo(request WSMessage, response WSMessage) WSMessage {
+	response.ID = request.ID
+	return response
 }
 
 // ReplaceSellersRequest represents a request to replace sellers
@@ -65,23 +137,72 @@ type ReplaceSellersRequest struct {
 	SellerPublicKeys []string `json:"sellerPublicKeys"`
 }
 
+// SelfInfo is the data of a selfInfo reply: who this node is and how it talks to its peers
+type SelfInfo struct {
+	PublicKey string   `json:"publicKey"`
+	PeerID    string   `json:"peerID"`
+	Role      string   `json:"role"`
+	Protocol  string   `json:"protocol"`  // the --protocol the SDK connects with
+	Protocols []string `json:"protocols"` // every protocol served, --protocol first
+	Addresses []string `json:"addresses"`
+	Version   string   `json:"version"`
+}
+
+// SendRequest is a P2P send made over HTTP (POST /buyer/p2p/send) or JSON-RPC (p2p.send)
+type SendRequest struct {
+	PublicKey  string      `json:"publicKey,omitempty"`  // one peer, or "*" for every peer
+	PublicKeys []string    `json:"publicKeys,omitempty"` // several peers
+	Data       interface{} `json:"data"`
+	Protocol   string      `json:"protocol,omitempty"` // defaults to --protocol
+}
+
+// broadcastPublicKey as the publicKey of a send addresses every peer in the buffer map
+const broadcastPublicKey = "*"
+
+// SendResult is the outcome for one recipient in the sendResults reply to a send with several recipients
+type SendResult struct {
+	PublicKey    string `json:"publicKey"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"` // error code, as in error messages
+	Message      string `json:"message"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+}
+
 // WebSocket upgrader
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true // In production, implement proper origin checking
-	},
+	Subprotocols:    []string{BinarySubprotocol},
+	CheckOrigin:     checkOrigin,
 }
 
-// Handle WebSocket connections
-func handleWebSocket(w http.ResponseWriter, r *http.Request, wsToP2P chan WSMessage, p2pToWS chan WSMessage) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// Handle WebSocket connections. Every connection is attached to the hub so that inbound P2P traffic reaches all clients.
+// handleWebSocket serves a /p2p endpoint. On a --protocol-paths endpoint, pinned is the only protocol the client
+// sends and receives on; it is empty on the shared endpoint.
+func handleWebSocket(w http.ResponseWriter, r *http.Request, hub *Hub, wsToP2P *SendQueue, pinned protocol.ID) {
+	// A reconnecting client presents its session token and the last sequence number it has seen
+	sessionToken := r.URL.Query().Get("session")
+	var lastSeq uint64
+	if value := r.URL.Query().Get("lastSeq"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid lastSeq %q", value), http.StatusBadRequest)
+			return
+		}
+		lastSeq = parsed
+	}
+
+	upgraded, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Failed to upgrade connection: %v", err)
 		return
 	}
-	defer conn.Close()
+	conn := newWSConn(upgraded, hub.name+" p2p", *WSMaxFrameBytes)
+	defer conn.finish()
+
+	client := hub.Register(conn, sessionToken, lastSeq, pinned)
+	defer hub.Unregister(client)
+	client.sendLimit = newRateLimiter(*P2PClientRate, *P2PClientBurst)
 
 	// Create a done channel to signal when the connection is closed
 	done := make(chan struct{})
@@ -90,33 +211,63 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request, wsToP2P chan WSMess
 	go func() {
 		defer close(done)
 		for {
-			var msg WSMessage
-			err := conn.ReadJSON(&msg)
+			messageType, data, err := conn.ReadMessage()
 			if err != nil {
 				log.Printf("Error reading message: %v", err)
 				return
 			}
-			wsToP2P <- msg
-		}
-	}()
 
-	// Send messages to client
-	for {
-		select {
-		case <-done:
-			return
-		case msg := <-p2pToWS:
-			err := conn.WriteJSON(msg)
+			var msg WSMessage
+			if messageType == websocket.BinaryMessage {
+				if !client.binary {
+					client.Send(WSMessage{
+						Type:      "error",
+						Data:      fmt.Sprintf("Binary frames require the %s subprotocol", BinarySubprotocol),
+						Timestamp: time.Now().UnixMilli(),
+						Error:     "BINARY_NOT_NEGOTIATED",
+					})
+					continue
+				}
+				msg, err = decodeBinaryFrame(data)
+			} else {
+				err = json.Unmarshal(data, &msg)
+			}
 			if err != nil {
-				log.Printf("Error writing message: %v", err)
-				return
+				client.Send(WSMessage{
+					Type:      "error",
+					Data:      fmt.Sprintf("Error parsing message: %v", err),
+					Timestamp: time.Now().UnixMilli(),
+					Error:     "PARSE_ERROR",
+				})
+				continue
+			}
+
+			// Subscriptions are handled per connection and never reach the P2P side
+			if msg.Type == "subscribe" || msg.Type == "unsubscribe" {
+				client.deliver(handleSubscription(client, msg))
+				continue
+			}
+			if !wsToP2P.Push(ClientMessage{Client: client, Message: msg}) {
+				client.Send(replyTo(msg, WSMessage{
+					Type:      "error",
+					Data:      "The node is shutting down and no longer sends messages",
+					Timestamp: time.Now().UnixMilli(),
+					Error:     "SHUTTING_DOWN",
+				}))
 			}
 		}
-	}
+	}()
+
+	// Ping the client and watch for idle connections
+	go conn.keepalive(done)
+
+	// Send messages to client
+	client.writePump(done)
 }
 
-// handleStream processes incoming messages from a P2P stream
-func handleStream(stream network.Stream, b *commonlib.NodeBuffers, p2pToWS chan WSMessage) {
+// handleStream processes incoming messages from a P2P stream. Reads block until a frame arrives; when ctx ends
+// the stream is reset, which unblocks the read and ends the loop.
+func handleStream(ctx context.Context, stream network.Stream, b *commonlib.NodeBuffers, hub *Hub) {
 	defer stream.Close()
 	peerID := stream.Conn().RemotePeer()
 	streamReader := bufio.NewReader(stream)
@@ -124,217 +275,358 @@ func handleStream(stream network.Stream, b *commonlib.NodeBuffers, p2pToWS chan
 	log.Printf("Stream established with peer %s and stream id %s\n", peerID, stream.ID())
 
 	// Get the public key from the peer ID
-	pubKey, err := peerID.ExtractPublicKey()
+	senderPublicKey, err := peerPublicKey(peerID)
 	if err != nil {
-		log.Printf("Error extracting public key from peer ID %s: %v", peerID, err)
-	}
-	var senderPublicKey string
-	if pubKey != nil {
-		pubKeyBytes, err := pubKey.Raw()
-		if err != nil {
-			log.Printf("Error getting raw public key bytes: %v", err)
-		} else {
-			senderPublicKey = common.Bytes2Hex(pubKeyBytes)
-		}
+		log.Printf("%v", err)
 	}
 
+	stopReset := context.AfterFunc(ctx, func() {
+		stream.Reset()
+	})
+	defer stopReset()
+
+	// The frame buffer is reused for every message, so the payload is copied before it is broadcast
+	var buffer []byte
 	for {
-		isStreamClosed := network.Stream.Conn(stream).IsClosed()
-		if isStreamClosed {
-			log.Printf("Stream seems to be closed for peer %s", peerID)
-			b.RemoveBuffer(peerID) // Clean up the buffer when stream is closed
-			break
+		payload, err := readStreamFrame(streamReader, *P2PMaxPayloadBytes, buffer)
+		buffer = payload
+		if errors.Is(err, errFrameTooLarge) {
+			// Skipping the payload would mean reading a size the peer chose, so the stream is given up
+			log.Printf("Resetting stream %s from peer %s: %v", stream.ID(), peerID, err)
+			stream.Reset()
+			return
 		}
-
-		// Set a read deadline to avoid blocking indefinitely
-		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
-
-		// Read data without requiring newline
-		buffer := make([]byte, 1024)
-		n, err := streamReader.Read(buffer)
-
-		// Check for timeout
 		if err != nil {
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				// This is a timeout, which is expected - add small delay to reduce CPU usage
-				time.Sleep(50 * time.Millisecond)
-				continue
+			switch {
+			case ctx.Err() != nil:
+				log.Printf("Stopped reading stream %s from peer %s: %v", stream.ID(), peerID, ctx.Err())
+			case errors.Is(err, io.EOF):
+				log.Printf("Stream %s closed by peer %s", stream.ID(), peerID)
+			default:
+				log.Printf("Error reading from stream: %v\n", err)
 			}
-
-			// For other errors, log them and break to avoid infinite error loop
-			log.Printf("Error reading from stream: %v\n", err)
-			break
-		}
-
-		if n > 0 {
-			// Forward the message to WebSocket
-			log.Printf("Received from %s: %s\n", peerID, string(buffer[:n]))
-			p2pToWS <- WSMessage{
-				Type:      "p2p",
-				Data:      string(buffer[:n]),
-				Timestamp: time.Now().UnixMilli(),
-				PublicKey: senderPublicKey, // Add the sender's public key to the message
+			if stream.Conn().IsClosed() {
+				log.Printf("Connection to peer %s is closed", peerID)
+				b.RemoveBuffer(peerID) // Clean up the buffer when the connection is gone
 			}
+			return
 		}
+
+		// Forward the message to WebSocket
+		log.Printf("Received from %s: %s\n", peerID, string(payload))
+		hub.Broadcast(WSMessage{
+			Type:      "p2p",
+			Raw:       bytes.Clone(payload), // also the data string of JSON clients, see WSMessage.MarshalJSON
+			Timestamp: time.Now().UnixMilli(),
+			PublicKey: senderPublicKey, // Add the sender's public key to the message
+			Protocol:  string(stream.Protocol()),
+		})
 	}
 }
 
 // Handle P2P messages from WebSocket and forward to peers. By default, the seller uses newStream and the buyer catches the event using setstreamhandler.
 // If we want the buyer to send a message to the seller then the buyer can either create newStream so that the seller's streamhandler fires or, ad it is done here,
 // we can "find" the stream and send the message to the seller.
-func handleP2PMessages(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, wsToP2P chan WSMessage, p2pToWS chan WSMessage, isBuyer bool) {
-	if isBuyer { // listens for  newstream
-		// Set up stream handler for incoming P2P messages (Buyer case)
-		log.Printf("Setting up stream handler for protocol %s", Protocol)
-		h.SetStreamHandler(Protocol, func(stream network.Stream) {
-			handleStream(stream, b, p2pToWS)
-		})
-	} else { // is seller finds existing stream and handles it
-		// Seller case - start a goroutine to handle incoming messages
-		go func() {
-			for {
-				select {
-				case <-ctx.Done():
-					return
-				default:
-					// Check for any active streams and handle them
-					for _, conn := range h.Network().Conns() {
-						streams := conn.GetStreams()
-						for _, stream := range streams {
-							if stream.Protocol() == Protocol {
-								handleStream(stream, b, p2pToWS)
-							}
-						}
-					}
-					// Add a small delay to prevent 100% CPU usage
-					time.Sleep(100 * time.Millisecond)
-				}
-			}
-		}()
+func handleP2PMessages(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, protocols protocolSet, wsToP2P *SendQueue, hub *Hub, isBuyer bool) {
+	streams := newStreamRegistry(ctx, b, hub, protocols)
+
+	// Streams opened by the other side (the buyer case, or a buyer that opens its own stream to the seller)
+	for _, protocolID := range protocols {
+		log.Printf("Setting up stream handler for protocol %s", protocolID)
+		h.SetStreamHandler(protocolID, streams.read)
+	}
+
+	if !isBuyer { // seller finds the streams the SDK opens on each connection
+		streams.watchConnections(h)
 	}
 
-	// Handle outgoing messages to peers
+	// Handle outgoing messages to peers. One loop sends for every client, so replies must never wait on a client's
+	// queue; they bypass it, whatever the slow consumer policy (see Client.Send).
+	peerLimits := newPeerRateLimiter(*P2PPeerRate, *P2PPeerBurst)
+	peerLimits.watchDisconnects(ctx, h)
 	go func() {
 		for {
 			select {
 			case <-ctx.Done():
 				return
-			case msg := <-wsToP2P:
-				// Convert message to bytes
-				msgBytes := []byte(msg.Data.(string) + "\n")
+			case req := <-wsToP2P.Messages():
+				sendToPeer(h, b, streams, peerLimits, req)
+				wsToP2P.Done()
+			}
+		}
+	}()
+}
 
-				// Get the target public key from the message
-				targetPublicKey := msg.PublicKey
-				if targetPublicKey == "" {
-					errorMsg := WSMessage{
-						Type:      "error",
-						Data:      "No target public key specified in message",
-						Timestamp: time.Now().UnixMilli(),
-						Error:     "MISSING_PUBLIC_KEY",
-					}
-					p2pToWS <- errorMsg
-					continue
-				}
+// sendToPeer forwards one message from a WebSocket client to the peer named in it, on the protocol named in it,
+// and replies to the client with the result
+func sendToPeer(h host.Host, b *commonlib.NodeBuffers, streams *streamRegistry, peerLimits *peerRateLimiter, req ClientMessage) {
+	msg := req.Message
 
-				// Log the received public key for debugging
-				log.Printf("Received public key: %s (length: %d)", targetPublicKey, len(targetPublicKey))
+	// Enforce the per-client limit before doing any work for the message. Sends that do not come from
+	// a hub client (POST /p2p/send) are limited by their endpoint.
+	if req.Client != nil {
+		if retryAfter, ok := takeToken(req.Client.sendLimit); !ok {
+			req.Reply(rateLimitedMessage("this client", retryAfter))
+			return
+		}
+	}
 
-				// Find the peer with matching public key
-				targetPeerIDStr, err := keylib.ConvertHederaPublicKeyToPeerID(targetPublicKey)
-				if err != nil {
-					errorMsg := WSMessage{
-						Type:      "error",
-						Data:      fmt.Sprintf("Error converting public key: %v", err),
-						Timestamp: time.Now().UnixMilli(),
-						Error:     "INVALID_PUBLIC_KEY",
-					}
-					p2pToWS <- errorMsg
-					continue
-				}
-				log.Printf("Converted public key %s to peer ID string: %s", targetPublicKey, targetPeerIDStr)
+	// Convert message to bytes. Raw payloads from binary frames are sent byte-exact.
+	msgBytes, err := payloadBytes(msg)
+	if err != nil {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Invalid message data: %v", err),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "INVALID_DATA",
+		}
+		req.Reply(errorMsg)
+		return
+	}
+	if len(msgBytes) > *P2PMaxPayloadBytes {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Payload of %d bytes exceeds the limit of %d bytes", len(msgBytes), *P2PMaxPayloadBytes),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "MESSAGE_TOO_LARGE",
+		}
+		req.Reply(errorMsg)
+		return
+	}
 
-				targetPeerID, err := peer.Decode(targetPeerIDStr)
-				if err != nil {
-					errorMsg := WSMessage{
-						Type:      "error",
-						Data:      fmt.Sprintf("Error decoding peer ID: %v", err),
-						Timestamp: time.Now().UnixMilli(),
-						Error:     "PEER_ID_DECODE_ERROR",
-					}
-					p2pToWS <- errorMsg
-					continue
-				}
-				log.Printf("Decoded peer ID: %s", targetPeerID.String())
+	// Pick the protocol: the one named in the message, else the endpoint's, else --protocol
+	protocolName := msg.Protocol
+	if req.Client != nil && req.Client.protocol != "" {
+		if protocolName == "" {
+			protocolName = string(req.Client.protocol)
+		} else if protocolName != string(req.Client.protocol) {
+			errorMsg := WSMessage{
+				Type:      "error",
+				Data:      fmt.Sprintf("This endpoint only sends on protocol %s", req.Client.protocol),
+				Timestamp: time.Now().UnixMilli(),
+				Error:     "INVALID_PROTOCOL",
+			}
+			req.Reply(errorMsg)
+			return
+		}
+	}
+	protocolID, err := streams.protocols.resolve(protocolName)
+	if err != nil {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      err.Error(),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "INVALID_PROTOCOL",
+		}
+		req.Reply(errorMsg)
+		return
+	}
 
-				// Debug: Print all available peer IDs in the buffer map
-				log.Printf("Available peer IDs in buffer map:")
-				for existingPeerID := range b.GetBufferMap() {
-					log.Printf("  - %s", existingPeerID.String())
-				}
+	// A send to one peer is answered with success or error. A send to every peer ("*") or to a publicKeys
+	// list is answered with a sendResults list holding the outcome for each recipient.
+	if msg.PublicKey != broadcastPublicKey && len(msg.PublicKeys) == 0 {
+		req.Reply(sendToOne(h, b, streams, peerLimits, protocolID, msg.PublicKey, msgBytes))
+		return
+	}
+	targets := recipients(b, msg)
+	if len(targets) == 0 {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      "There are no peers to send to",
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "PEER_NOT_FOUND",
+		}
+		req.Reply(errorMsg)
+		return
+	}
+	results := make([]SendResult, 0, len(targets))
+	for _, targetPublicKey := range targets {
+		reply := sendToOne(h, b, streams, peerLimits, protocolID, targetPublicKey, msgBytes)
+		results = append(results, SendResult{
+			PublicKey:    targetPublicKey,
+			Success:      reply.Type != "error",
+			Error:        reply.Error,
+			Message:      fmt.Sprint(reply.Data),
+			RetryAfterMs: reply.RetryAfterMs,
+		})
+	}
+	req.Reply(WSMessage{
+		Type:      "sendResults",
+		Data:      results,
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
 
-				// Get buffer info for the target peer
-				bufferInfo, exists := b.GetBuffer(targetPeerID)
-				if !exists {
-					errorMsg := WSMessage{
-						Type:      "error",
-						Data:      fmt.Sprintf("No buffer found for peer %s", targetPublicKey),
-						Timestamp: time.Now().UnixMilli(),
-						Error:     "PEER_NOT_FOUND",
-					}
-					p2pToWS <- errorMsg
-					continue
-				}
+// sendToOne sends an encoded payload to the peer with the given public key and returns the reply for that peer
+func sendToOne(h host.Host, b *commonlib.NodeBuffers, streams *streamRegistry, peerLimits *peerRateLimiter, protocolID protocol.ID, targetPublicKey string, msgBytes []byte) WSMessage {
+	// Get the target public key from the message
+	if targetPublicKey == "" {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      "No target public key specified in message",
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "MISSING_PUBLIC_KEY",
+		}
+		return errorMsg
+	}
 
-				// Send the message to the specific peer
-				log.Printf("Sending message to peer %s", targetPublicKey)
-				sendError := commonlib.WriteAndFlushBuffer(*bufferInfo, targetPeerID, b, msgBytes, h, Protocol)
-				if sendError != nil {
-					// Send the public connectivity error message for the other peer's sdk to handle
-					hedera_msg.PeerSendErrorMessage(
-						bufferInfo.RequestOrResponse.OtherStdInTopic,
-						types.WriteError,
-						"Failed to send message: "+sendError.Error()+string(msgBytes),
-						types.SendFreshHederaRequest,
-					)
-					errorMsg := WSMessage{
-						Type:      "error",
-						Data:      fmt.Sprintf("Error sending to peer %s: %v", targetPublicKey, sendError),
-						Timestamp: time.Now().UnixMilli(),
-						Error:     "SEND_ERROR",
-					}
-					p2pToWS <- errorMsg
-					continue
-				}
+	// Log the received public key for debugging
+	log.Printf("Received public key: %s (length: %d)", targetPublicKey, len(targetPublicKey))
 
-				// Send success response
-				successMsg := WSMessage{
-					Type:      "success",
-					Data:      fmt.Sprintf("Successfully sent message to peer %s", targetPublicKey),
-					Timestamp: time.Now().UnixMilli(),
-				}
-				p2pToWS <- successMsg
+	// Find the peer with matching public key
+	targetPeerIDStr, err := keylib.ConvertHederaPublicKeyToPeerID(targetPublicKey)
+	if err != nil {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Error converting public key: %v", err),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "INVALID_PUBLIC_KEY",
+		}
+		return errorMsg
+	}
+	log.Printf("Converted public key %s to peer ID string: %s", targetPublicKey, targetPeerIDStr)
+
+	targetPeerID, err := peer.Decode(targetPeerIDStr)
+	if err != nil {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Error decoding peer ID: %v", err),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "PEER_ID_DECODE_ERROR",
+		}
+		return errorMsg
+	}
+	log.Printf("Decoded peer ID: %s", targetPeerID.String())
+
+	// Debug: Print all available peer IDs in the buffer map
+	log.Printf("Available peer IDs in buffer map:")
+	for existingPeerID := range b.GetBufferMap() {
+		log.Printf("  - %s", existingPeerID.String())
+	}
+
+	// Get buffer info for the target peer
+	bufferInfo, exists := b.GetBuffer(targetPeerID)
+	if !exists {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("No buffer found for peer %s", targetPublicKey),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "PEER_NOT_FOUND",
+		}
+		return errorMsg
+	}
+
+	// Enforce the per-peer limit shared by all clients
+	if retryAfter, ok := peerLimits.take(targetPeerID); !ok {
+		return rateLimitedMessage("peer "+targetPublicKey, retryAfter)
+	}
+
+	// Streams of the additional protocols are opened on demand
+	if err := streams.ensureStream(h, targetPeerID, protocolID); err != nil {
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Error sending to peer %s: %v", targetPublicKey, err),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "SEND_ERROR",
+		}
+		return errorMsg
+	}
+
+	// Send the message to the specific peer
+	log.Printf("Sending message to peer %s on %s", targetPublicKey, protocolID)
+	sendError := commonlib.WriteAndFlushBuffer(*bufferInfo, targetPeerID, b, encodeStreamFrame(msgBytes), h, protocolID)
+	if sendError != nil {
+		// Send the public connectivity error message for the other peer's sdk to handle. Not during shutdown:
+		// the failure is ours then, and each message costs a Hedera transaction.
+		if !shuttingDown() {
+			hedera_msg.PeerSendErrorMessage(
+				bufferInfo.RequestOrResponse.OtherStdInTopic,
+				types.WriteError,
+				"Failed to send message: "+sendError.Error()+string(msgBytes),
+				types.SendFreshHederaRequest,
+			)
+		}
+		errorMsg := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Error sending to peer %s: %v", targetPublicKey, sendError),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "SEND_ERROR",
+		}
+		return errorMsg
+	}
+
+	// Send success response
+	successMsg := WSMessage{
+		Type:      "success",
+		Data:      fmt.Sprintf("Successfully sent message to peer %s", targetPublicKey),
+		Timestamp: time.Now().UnixMilli(),
+	}
+	return successMsg
+}
+
+// recipients lists the public keys a send goes to: every peer in the buffer map for publicKey "*", otherwise
+// publicKey, followed by the publicKeys list. Keys named more than once are sent to once.
+func recipients(b *commonlib.NodeBuffers, msg WSMessage) []string {
+	var targets []string
+	if msg.PublicKey == broadcastPublicKey {
+		for peerID := range b.GetBufferMap() {
+			publicKey, err := peerPublicKey(peerID)
+			if err != nil {
+				log.Printf("Skipping peer %s in broadcast: %v", peerID, err)
+				continue
 			}
+			targets = append(targets, publicKey)
 		}
-	}()
+		sort.Strings(targets)
+	} else if msg.PublicKey != "" {
+		targets = append(targets, msg.PublicKey)
+	}
+	targets = append(targets, msg.PublicKeys...)
+
+	seen := make(map[string]struct{}, len(targets))
+	unique := targets[:0]
+	for _, publicKey := range targets {
+		key := strings.ToLower(publicKey)
+		if _, dup := seen[key]; dup {
+			continue
+		}
+		seen[key] = struct{}{}
+		unique = append(unique, publicKey)
+	}
+	return unique
+}
+
+// peerPublicKey returns the hex public key of a peer, the form clients name peers by
+func peerPublicKey(peerID peer.ID) (string, error) {
+	pubKey, err := peerID.ExtractPublicKey()
+	if err != nil {
+		return "", fmt.Errorf("error extracting public key from peer ID %s: %w", peerID, err)
+	}
+	pubKeyBytes, err := pubKey.Raw()
+	if err != nil {
+		return "", fmt.Errorf("error getting raw public key bytes: %w", err)
+	}
+	return common.Bytes2Hex(pubKeyBytes), nil
 }
 
 // Add internal command handler for buyer (separate from P2P)
-func handleBuyerInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, commands chan WSMessage, responses chan WSMessage) {
-	handleInternalCommands(ctx, h, b, commands, responses, true)
+func handleBuyerInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, protocols protocolSet, commands chan ClientMessage) {
+	handleInternalCommands(ctx, h, b, protocols, commands, true)
 }
 
 // Add internal command handler for seller (separate from P2P)
-func handleSellerInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, commands chan WSMessage, responses chan WSMessage) {
-	handleInternalCommands(ctx, h, b, commands, responses, false)
+func handleSellerInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, protocols protocolSet, commands chan ClientMessage) {
+	handleInternalCommands(ctx, h, b, protocols, commands, false)
 }
 
-// Generic internal command handler that works for both buyers and sellers
-func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, commands chan WSMessage, responses chan WSMessage, isBuyer bool) {
+// Generic internal command handler that works for both buyers and sellers. Each command is answered through its own Reply.
+func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeBuffers, protocols protocolSet, commands chan ClientMessage, isBuyer bool) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case msg := <-commands:
+		case req := <-commands:
+			msg := req.Message
 			if msg.Type == "replaceSellers" {
 				if !isBuyer {
 					// Sellers cannot replace sellers - this is a buyer-only operation
@@ -344,12 +636,26 @@ func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeB
 						Timestamp: time.Now().UnixMilli(),
 						Error:     "BUYER_ONLY_OPERATION",
 					}
-					responses <- errorMsg
+					req.Reply(errorMsg)
+					continue
+				}
+
+				// The request may be sent as a JSON object or as a string containing JSON
+				switch msg.Data.(type) {
+				case string, map[string]interface{}:
+				default:
+					errorMsg := WSMessage{
+						Type:      "error",
+						Data:      fmt.Sprintf("replaceSellers data must be a JSON object or a string containing one, got %T", msg.Data),
+						Timestamp: time.Now().UnixMilli(),
+						Error:     "INVALID_DATA",
+					}
+					req.Reply(errorMsg)
 					continue
 				}
 
 				request := ReplaceSellersRequest{}
-				err := json.Unmarshal([]byte(msg.Data.(string)), &request)
+				err := decodeData(msg.Data, &request)
 				if err != nil {
 					errorMsg := WSMessage{
 						Type:      "error",
@@ -357,7 +663,7 @@ func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeB
 						Timestamp: time.Now().UnixMilli(),
 						Error:     "PARSE_ERROR",
 					}
-					responses <- errorMsg
+					req.Reply(errorMsg)
 					continue
 				}
 
@@ -372,12 +678,12 @@ func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeB
 						Timestamp: time.Now().UnixMilli(),
 						Error:     "NO_ADDRESSES",
 					}
-					responses <- errorMsg
+					req.Reply(errorMsg)
 					continue
 				}
 
 				// Call the SDK's ReplaceSellersAuto function
-				err = neuronsdk.ReplaceSellersAuto(request.SellerPublicKeys, h, b, myReachableAddresses, Protocol)
+				err = neuronsdk.ReplaceSellersAuto(request.SellerPublicKeys, h, b, myReachableAddresses, protocols.primary())
 				if err != nil {
 					errorMsg := WSMessage{
 						Type:      "error",
@@ -385,7 +691,7 @@ func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeB
 						Timestamp: time.Now().UnixMilli(),
 						Error:     "REPLACE_ERROR",
 					}
-					responses <- errorMsg
+					req.Reply(errorMsg)
 					continue
 				}
 
@@ -395,7 +701,7 @@ func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeB
 					Data:      fmt.Sprintf("Successfully replaced sellers with %d new sellers", len(request.SellerPublicKeys)),
 					Timestamp: time.Now().UnixMilli(),
 				}
-				responses <- successMsg
+				req.Reply(successMsg)
 			} else if msg.Type == "showCurrentPeers" {
 				// Get detailed current peer status (works for both buyers and sellers)
 				detailedPeerStatus := neuronsdk.ShowDetailedPeerStatus(b, h)
@@ -405,7 +711,32 @@ func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeB
 					Data:      detailedPeerStatus,
 					Timestamp: time.Now().UnixMilli(),
 				}
-				responses <- responseMsg
+				req.Reply(responseMsg)
+			} else if msg.Type == "showSelfInfo" {
+				// Report this node's identity and the protocol it speaks (works for both buyers and sellers)
+				addresses := []string{}
+				for _, addr := range h.Addrs() {
+					addresses = append(addresses, addr.String())
+				}
+				role := "seller"
+				if isBuyer {
+					role = "buyer"
+				}
+
+				responseMsg := WSMessage{
+					Type: "selfInfo",
+					Data: SelfInfo{
+						PublicKey: commonlib.MyPublicKey.StringRaw(),
+						PeerID:    h.ID().String(),
+						Role:      role,
+						Protocol:  string(protocols.primary()),
+						Protocols: protocols.strings(),
+						Addresses: addresses,
+						Version:   AppVersion,
+					},
+					Timestamp: time.Now().UnixMilli(),
+				}
+				req.Reply(responseMsg)
 			} else {
 				// Unknown command
 				errorMsg := WSMessage{
@@ -414,28 +745,28 @@ func handleInternalCommands(ctx context.Context, h host.Host, b *commonlib.NodeB
 					Timestamp: time.Now().UnixMilli(),
 					Error:     "UNKNOWN_COMMAND",
 				}
-				responses <- errorMsg
+				req.Reply(errorMsg)
 			}
 		}
 	}
 }
 
 // handleInternalCommandsWebSocket handles WebSocket connections for internal commands
-func handleInternalCommandsWebSocket(w http.ResponseWriter, r *http.Request, commands chan WSMessage, responses chan WSMessage) {
+func handleInternalCommandsWebSocket(w http.ResponseWriter, r *http.Request, endpoint string, commands chan ClientMessage) {
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true // Allow all origins for development
-		},
+		CheckOrigin: checkOrigin,
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	upgraded, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Printf("Error upgrading connection: %v", err)
 		return
 	}
-	defer conn.Close()
+	conn := newWSConn(upgraded, endpoint, *CommandsMaxPayloadBytes)
+	defer conn.finish()
 
 	done := make(chan struct{})
+	responses := make(chan WSMessage)
 
 	// Handle incoming messages from client
 	go func() {
@@ -450,11 +781,19 @@ func handleInternalCommandsWebSocket(w http.ResponseWriter, r *http.Request, com
 				return
 			}
 
-			// Forward message to internal command handler
-			commands <- msg
+			// Forward message to internal command handler, which answers on this connection only
+			commands <- ClientMessage{Message: msg, Respond: func(response WSMessage) {
+				select {
+				case responses <- response:
+				case <-done:
+				}
+			}}
 		}
 	}()
 
+	// Ping the client and watch for idle connections
+	go conn.keepalive(done)
+
 	// Send responses to client
 	for {
 		select {
@@ -474,78 +813,202 @@ func main() {
 	// Parse command line flags
 	pflag.Parse()
 
-	// Create separate channels for WebSocket to P2P and P2P to WebSocket
-	buyerWSToP2P := make(chan WSMessage)
-	buyerP2PToWS := make(chan WSMessage)
-	sellerWSToP2P := make(chan WSMessage)
-	sellerP2PToWS := make(chan WSMessage)
+	// Catch SIGINT/SIGTERM for the graceful shutdown
+	signal.Notify(shutdownSignals, syscall.SIGINT, syscall.SIGTERM)
+
+	protocols, err := parseProtocols(*ProtocolFlag, *ProtocolsFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	protocolPaths, err = parseProtocolPaths(*ProtocolPathsFlag, protocols)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slowConsumerPolicy, err := ParseSlowConsumerPolicy(*WSSlowConsumerPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *TopicMessageType != "p2p" && *TopicMessageType != "topic" {
+		log.Fatalf("--topic-message-type must be p2p or topic, got %q", *TopicMessageType)
+	}
+	if *WSQueueSize < 1 {
+		log.Fatalf("--ws-queue-size must be at least 1, got %d", *WSQueueSize)
+	}
+	if *WSReplayBuffer < 0 {
+		log.Fatalf("--ws-replay-buffer must not be negative, got %d", *WSReplayBuffer)
+	}
+	if *WSMaxSessions < 0 {
+		log.Fatalf("--ws-max-sessions must not be negative, got %d", *WSMaxSessions)
+	}
+	if *WSMaxFrameBytes < 1 || *P2PMaxPayloadBytes < 1 || *CommandsMaxPayloadBytes < 1 {
+		log.Fatalf("--ws-max-frame-bytes, --p2p-max-payload-bytes and --commands-max-payload-bytes must be positive")
+	}
+	if *WSWriteTimeout <= 0 {
+		log.Fatalf("--ws-write-timeout must be positive, got %s", *WSWriteTimeout)
+	}
+	if *WSPingInterval > 0 && *WSPongTimeout > 0 && *WSPingInterval >= *WSPongTimeout {
+		log.Fatalf("--ws-ping-interval (%s) must be shorter than --ws-pong-timeout (%s)", *WSPingInterval, *WSPongTimeout)
+	}
+
+	if role := activeRole(); role != "buyer" && role != "seller" {
+		log.Fatalf("--buyer-or-seller must be buyer or seller, got %q", role)
+	}
+
+	if len(*WSAllowedOrigins) == 0 {
+		log.Printf("Warning: --ws-allowed-origins is empty, WebSocket connections are accepted from any origin")
+	}
+	if *WSP2PToken == "" || *WSCommandsToken == "" || *WSRPCToken == "" {
+		log.Printf("Warning: --ws-p2p-token, --ws-commands-token or --ws-rpc-token is empty, those endpoints accept unauthenticated clients")
+	}
+
+	// Create separate channels for WebSocket to P2P, and a hub per role that fans P2P traffic out to every WebSocket client
+	buyerWSToP2P := NewSendQueue()
+	sellerWSToP2P := NewSendQueue()
+	buyerHub := NewHub("buyer", *WSQueueSize, slowConsumerPolicy, *WSReplayBuffer, *WSSessionTTL, *WSMaxSessions)
+	sellerHub := NewHub("seller", *WSQueueSize, slowConsumerPolicy, *WSReplayBuffer, *WSSessionTTL, *WSMaxSessions)
 
 	// Create separate channels for internal commands (buyer only)
-	buyerInternalCommands := make(chan WSMessage)
-	buyerInternalResponses := make(chan WSMessage)
+	buyerInternalCommands := make(chan ClientMessage)
 
 	// Create separate channels for internal commands (seller only)
-	sellerInternalCommands := make(chan WSMessage)
-	sellerInternalResponses := make(chan WSMessage)
+	sellerInternalCommands := make(chan ClientMessage)
+
+	// Report the active role; the other role's endpoints answer ROLE_NOT_ACTIVE
+	http.HandleFunc("/role", handleRole)
+
+	// Serve the API descriptions generated from the message types
+	http.HandleFunc("/asyncapi.json", serveAPIDocument(buildAsyncAPI))
+	http.HandleFunc("/openapi.json", serveAPIDocument(buildOpenAPI))
 
 	// Set up HTTP routes for P2P
-	http.HandleFunc("/buyer/p2p", func(w http.ResponseWriter, r *http.Request) {
-		handleWebSocket(w, r, buyerWSToP2P, buyerP2PToWS)
-	})
-	http.HandleFunc("/seller/p2p", func(w http.ResponseWriter, r *http.Request) {
-		handleWebSocket(w, r, sellerWSToP2P, sellerP2PToWS)
-	})
+	http.HandleFunc("/buyer/p2p", requireRole("buyer", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(w, r, buyerHub, buyerWSToP2P, "")
+	})))
+	http.HandleFunc("/seller/p2p", requireRole("seller", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(w, r, sellerHub, sellerWSToP2P, "")
+	})))
+
+	// Set up the WebSocket routes dedicated to one protocol
+	for _, path := range protocolPaths {
+		http.HandleFunc("/buyer/p2p/"+path.Name, requireRole("buyer", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+			handleWebSocket(w, r, buyerHub, buyerWSToP2P, path.Protocol)
+		})))
+		http.HandleFunc("/seller/p2p/"+path.Name, requireRole("seller", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+			handleWebSocket(w, r, sellerHub, sellerWSToP2P, path.Protocol)
+		})))
+	}
+
+	// Set up HTTP routes for sending over plain HTTP and receiving as Server-Sent Events
+	buyerHTTPSendLimit := newCallerRateLimiter(*P2PClientRate, *P2PClientBurst)
+	sellerHTTPSendLimit := newCallerRateLimiter(*P2PClientRate, *P2PClientBurst)
+	http.HandleFunc("/buyer/p2p/send", requireRole("buyer", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+		handleSendHTTP(w, r, buyerWSToP2P, buyerHTTPSendLimit)
+	})))
+	http.HandleFunc("/seller/p2p/send", requireRole("seller", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+		handleSendHTTP(w, r, sellerWSToP2P, sellerHTTPSendLimit)
+	})))
+	http.HandleFunc("/buyer/p2p/events", requireRole("buyer", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+		handleEventsSSE(w, r, buyerHub)
+	})))
+	http.HandleFunc("/seller/p2p/events", requireRole("seller", requireToken(WSP2PToken, func(w http.ResponseWriter, r *http.Request) {
+		handleEventsSSE(w, r, sellerHub)
+	})))
 
 	// Set up HTTP route for buyer internal commands
-	http.HandleFunc("/buyer/commands", func(w http.ResponseWriter, r *http.Request) {
-		handleInternalCommandsWebSocket(w, r, buyerInternalCommands, buyerInternalResponses)
-	})
+	http.HandleFunc("/buyer/commands", requireRole("buyer", requireToken(WSCommandsToken, func(w http.ResponseWriter, r *http.Request) {
+		handleInternalCommandsWebSocket(w, r, "buyer commands", buyerInternalCommands)
+	})))
 
 	// Set up HTTP route for seller internal commands
-	http.HandleFunc("/seller/commands", func(w http.ResponseWriter, r *http.Request) {
-		handleInternalCommandsWebSocket(w, r, sellerInternalCommands, sellerInternalResponses)
-	})
+	http.HandleFunc("/seller/commands", requireRole("seller", requireToken(WSCommandsToken, func(w http.ResponseWriter, r *http.Request) {
+		handleInternalCommandsWebSocket(w, r, "seller commands", sellerInternalCommands)
+	})))
+
+	// Set up REST routes for internal commands
+	http.HandleFunc("/buyer/peers", requireRole("buyer", requireToken(WSCommandsToken, func(w http.ResponseWriter, r *http.Request) {
+		handlePeersREST(w, r, buyerInternalCommands)
+	})))
+	http.HandleFunc("/seller/peers", requireRole("seller", requireToken(WSCommandsToken, func(w http.ResponseWriter, r *http.Request) {
+		handlePeersREST(w, r, sellerInternalCommands)
+	})))
+	http.HandleFunc("/buyer/sellers", requireRole("buyer", requireToken(WSCommandsToken, func(w http.ResponseWriter, r *http.Request) {
+		handleSellersREST(w, r, buyerInternalCommands)
+	})))
+
+	// Set up HTTP route for JSON-RPC, served by whichever role is active
+	rpcHub, rpcWSToP2P, rpcCommands := sellerHub, sellerWSToP2P, sellerInternalCommands
+	if activeRole() == "buyer" {
+		rpcHub, rpcWSToP2P, rpcCommands = buyerHub, buyerWSToP2P, buyerInternalCommands
+	}
+	http.HandleFunc("/rpc", requireToken(WSRPCToken, func(w http.ResponseWriter, r *http.Request) {
+		handleRPCWebSocket(w, r, rpcHub, rpcWSToP2P, rpcCommands)
+	}))
+
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Start HTTP server
+	server, err := startServer(tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// LaunchSDK blocks until the SDK stops; run it in the background so a signal triggers the graceful shutdown
+	sdkDone := make(chan struct{})
 	go func() {
-		addr := fmt.Sprintf(":%d", *WSPort)
-		log.Printf("Starting WebSocket server on %s", addr)
-		if err := http.ListenAndServe(addr, nil); err != nil {
-			log.Fatal("ListenAndServe: ", err)
-		}
+		defer close(sdkDone)
+		launchSDK(protocols, buyerHub, sellerHub, buyerWSToP2P, sellerWSToP2P, buyerInternalCommands, sellerInternalCommands)
 	}()
 
+	select {
+	case sig := <-shutdownSignals:
+		log.Printf("Received %s, shutting down gracefully", sig)
+	case <-sdkDone:
+		log.Printf("SDK stopped, shutting down")
+	}
+	gracefulShutdown(server, buyerWSToP2P, sellerWSToP2P)
+}
+
+// launchSDK starts the SDK with the buyer and seller callbacks wired to the WebSocket hubs and queues
+func launchSDK(protocols protocolSet, buyerHub *Hub, sellerHub *Hub, buyerWSToP2P *SendQueue, sellerWSToP2P *SendQueue, buyerInternalCommands chan ClientMessage, sellerInternalCommands chan ClientMessage) {
+	protocolID := protocols.primary() // the SDK connects buyers and sellers on --protocol
 	neuronsdk.LaunchSDK(
-		"0.1",    // Specify your app's version
-		Protocol, // Specify a protocol ID
-		nil,      // leave nil if you don't need custom key configuration logic
+		AppVersion, // Specify your app's version
+		protocolID, // Specify a protocol ID
+		nil,        // leave nil if you don't need custom key configuration logic
 		func(ctx context.Context, h host.Host, b *commonlib.NodeBuffers) { // Define buyer case logic here
-			handleP2PMessages(ctx, h, b, buyerWSToP2P, buyerP2PToWS, true)
+			ctx = withAppContext(ctx)
+			takeOverShutdownSignals(h)
+			handleP2PMessages(ctx, h, b, protocols, buyerWSToP2P, buyerHub, true)
 
 			// Add internal command handler for buyer (separate from P2P)
-			go handleBuyerInternalCommands(ctx, h, b, buyerInternalCommands, buyerInternalResponses)
+			go handleBuyerInternalCommands(ctx, h, b, protocols, buyerInternalCommands)
 		},
 		func(msg hedera.TopicMessage) { // Define buyer topic callback logic here
 			// Handle buyer topic messages
-			buyerP2PToWS <- WSMessage{
-				Type:      "p2p",
+			buyerHub.Broadcast(WSMessage{
+				Type:      *TopicMessageType,
 				Data:      string(msg.Contents),
 				Timestamp: time.Now().UnixMilli(),
-			}
+			})
 		},
 		func(ctx context.Context, h host.Host, b *commonlib.NodeBuffers) { // Define seller case logic here
-			handleP2PMessages(ctx, h, b, sellerWSToP2P, sellerP2PToWS, false)
+			ctx = withAppContext(ctx)
+			takeOverShutdownSignals(h)
+			handleP2PMessages(ctx, h, b, protocols, sellerWSToP2P, sellerHub, false)
 
 			// Add internal command handler for seller (separate from P2P)
-			go handleSellerInternalCommands(ctx, h, b, sellerInternalCommands, sellerInternalResponses)
+			go handleSellerInternalCommands(ctx, h, b, protocols, sellerInternalCommands)
 		},
 		func(msg hedera.TopicMessage) {
 			// Handle seller topic messages
-			sellerP2PToWS <- WSMessage{
-				Type:      "p2p",
+			sellerHub.Broadcast(WSMessage{
+				Type:      *TopicMessageType,
 				Data:      string(msg.Contents),
 				Timestamp: time.Now().UnixMilli(),
-			}
+			})
 		},
 	)
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"testing"
+)
+
+// The SDK checks its configuration when the package is loaded, before any test runs, so the tests need what the
+// wrapper needs to start, without network access:
+//
+//	smart_contract_address=0x... go test . -args --port=1 --use-local-address
+//
+// Those flags belong to the SDK; they are declared to the test binary as well so that it accepts them.
+func init() {
+	flag.String("port", "", "SDK listen port, see the SDK")
+	flag.Bool("use-local-address", false, "SDK local addresses only, see the SDK")
+}
+
+func TestWSMessageMarshalJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  WSMessage
+		data interface{}
+	}{
+		{"raw payload", WSMessage{Type: "p2p", Raw: []byte("hello")}, "hello"},
+		{"empty raw payload", WSMessage{Type: "p2p", Raw: []byte{}}, ""},
+		{"data wins over raw", WSMessage{Type: "p2p", Data: "text", Raw: []byte("raw")}, "text"},
+		{"data only", WSMessage{Type: "success", Data: "done"}, "done"},
+		{"neither", WSMessage{Type: "unsubscribe"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := json.Marshal(tt.msg)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			var decoded map[string]interface{}
+			if err := json.Unmarshal(encoded, &decoded); err != nil {
+				t.Fatalf("Unmarshal %s: %v", encoded, err)
+			}
+			if decoded["data"] != tt.data {
+				t.Errorf("data = %#v, want %#v in %s", decoded["data"], tt.data, encoded)
+			}
+			if decoded["type"] != tt.msg.Type {
+				t.Errorf("type = %#v, want %q", decoded["type"], tt.msg.Type)
+			}
+		})
+	}
+}
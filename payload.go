@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// errNoData is returned when a message that needs a payload has no data field
+var errNoData = errors.New("message has no data")
+
+// payloadBytes converts the payload of a p2p message into the bytes sent to the peer, before framing.
+// Raw payloads from binary frames are used as they are. A string is sent as its text and any other
+// JSON value (object, array, number, boolean) is sent as its JSON encoding.
+func payloadBytes(msg WSMessage) ([]byte, error) {
+	if msg.Raw != nil {
+		return msg.Raw, nil
+	}
+	switch data := msg.Data.(type) {
+	case nil:
+		return nil, errNoData
+	case string:
+		return []byte(data), nil
+	default:
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot encode data as JSON: %w", err)
+		}
+		return encoded, nil
+	}
+}
+
+// decodeData unmarshals a WSMessage data field into v. The data may be a JSON object or a string that contains JSON.
+func decodeData(data interface{}, v interface{}) error {
+	if s, ok := data.(string); ok {
+		return json.Unmarshal([]byte(s), v)
+	}
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
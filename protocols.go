@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// protocolPathReserved are names that cannot be used by --protocol-paths because they are endpoints of their own
+var protocolPathReserved = []string{"send", "events"}
+
+// protocolSet lists the application protocols this node serves. The first is --protocol, which the SDK uses to
+// connect buyers and sellers; the others (--protocols) run on streams of their own over the same connections.
+type protocolSet []protocol.ID
+
+// protocolPath is a WebSocket endpoint dedicated to one protocol, /buyer/p2p/<name> and /seller/p2p/<name>
+type protocolPath struct {
+	Name     string
+	Protocol protocol.ID
+}
+
+// protocolPaths are the dedicated endpoints configured with --protocol-paths, set once the flags are validated
+var protocolPaths []protocolPath
+
+// parseProtocolID validates a protocol ID given on the command line. It runs after flag parsing, so the value
+// given is the one used; a libp2p protocol ID is non-empty printable ASCII without spaces.
+func parseProtocolID(name string) (protocol.ID, error) {
+	if name == "" {
+		return "", errors.New("protocol ID must not be empty")
+	}
+	for _, r := range name {
+		if r <= ' ' || r > '~' {
+			return "", fmt.Errorf("protocol ID %q must be printable ASCII without spaces", name)
+		}
+	}
+	return protocol.ID(name), nil
+}
+
+// parseProtocols builds the set of served protocols from --protocol and --protocols
+func parseProtocols(primary string, extra []string) (protocolSet, error) {
+	first, err := parseProtocolID(primary)
+	if err != nil {
+		return nil, fmt.Errorf("--protocol: %w", err)
+	}
+	set := protocolSet{first}
+	for _, name := range extra {
+		id, err := parseProtocolID(name)
+		if err != nil {
+			return nil, fmt.Errorf("--protocols: %w", err)
+		}
+		if !set.has(id) {
+			set = append(set, id)
+		}
+	}
+	return set, nil
+}
+
+// parseProtocolPaths validates --protocol-paths, given as <name>=<protocol ID>. Every protocol must be one
+// this node serves, and every name must be a single path segment that is not already an endpoint.
+func parseProtocolPaths(paths map[string]string, protocols protocolSet) ([]protocolPath, error) {
+	parsed := make([]protocolPath, 0, len(paths))
+	for name, id := range paths {
+		if name == "" || strings.ContainsAny(name, "/?#%") || slices.Contains(protocolPathReserved, name) {
+			return nil, fmt.Errorf("--protocol-paths: %q cannot be used as a path name", name)
+		}
+		if !protocols.has(protocol.ID(id)) {
+			return nil, fmt.Errorf("--protocol-paths: %s is not one of the served protocols %s", id, protocols)
+		}
+		parsed = append(parsed, protocolPath{Name: name, Protocol: protocol.ID(id)})
+	}
+	sort.Slice(parsed, func(i, j int) bool { return parsed[i].Name < parsed[j].Name })
+	return parsed, nil
+}
+
+// primary returns the protocol given to the SDK, used when a message does not name one
+func (s protocolSet) primary() protocol.ID {
+	return s[0]
+}
+
+// has reports whether the protocol is served by this node
+func (s protocolSet) has(id protocol.ID) bool {
+	return slices.Contains(s, id)
+}
+
+// resolve returns the protocol a message is sent on: the one it names, or the primary protocol when it names none
+func (s protocolSet) resolve(name string) (protocol.ID, error) {
+	if name == "" {
+		return s.primary(), nil
+	}
+	if !s.has(protocol.ID(name)) {
+		return "", fmt.Errorf("protocol %q is not served by this node, use one of %s", name, s)
+	}
+	return protocol.ID(name), nil
+}
+
+// strings returns the protocol IDs as strings, for JSON replies
+func (s protocolSet) strings() []string {
+	names := make([]string, len(s))
+	for i, id := range s {
+		names[i] = string(id)
+	}
+	return names
+}
+
+func (s protocolSet) String() string {
+	return strings.Join(s.strings(), ", ")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+func TestParseProtocols(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary string
+		extra   []string
+		want    protocolSet
+		wantErr bool
+	}{
+		{"primary only", "nrn-nodered/v2", nil, protocolSet{"nrn-nodered/v2"}, false},
+		{"additional protocols", "nrn-nodered/v2", []string{"/adsb/v1", "/radiation/v1"}, protocolSet{"nrn-nodered/v2", "/adsb/v1", "/radiation/v1"}, false},
+		{"duplicates dropped", "nrn-nodered/v2", []string{"/adsb/v1", "nrn-nodered/v2", "/adsb/v1"}, protocolSet{"nrn-nodered/v2", "/adsb/v1"}, false},
+		{"empty primary", "", nil, nil, true},
+		{"primary with space", "nrn nodered", nil, nil, true},
+		{"empty additional", "nrn-nodered/v2", []string{""}, nil, true},
+		{"non ASCII additional", "nrn-nodered/v2", []string{"/adsb/v1é"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProtocols(tt.primary, tt.extra)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("protocols = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseProtocolPaths(t *testing.T) {
+	served := protocolSet{"nrn-nodered/v2", "/adsb/v1"}
+	tests := []struct {
+		name    string
+		paths   map[string]string
+		want    []protocolPath
+		wantErr bool
+	}{
+		{"none", nil, []protocolPath{}, false},
+		{"sorted by name", map[string]string{"nodered": "nrn-nodered/v2", "adsb": "/adsb/v1"}, []protocolPath{{"adsb", "/adsb/v1"}, {"nodered", "nrn-nodered/v2"}}, false},
+		{"protocol not served", map[string]string{"other": "/other/v1"}, nil, true},
+		{"empty name", map[string]string{"": "/adsb/v1"}, nil, true},
+		{"name with slash", map[string]string{"a/b": "/adsb/v1"}, nil, true},
+		{"name with query", map[string]string{"a?b": "/adsb/v1"}, nil, true},
+		{"reserved send", map[string]string{"send": "/adsb/v1"}, nil, true},
+		{"reserved events", map[string]string{"events": "/adsb/v1"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProtocolPaths(tt.paths, served)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("paths = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtocolSetResolve(t *testing.T) {
+	served := protocolSet{"nrn-nodered/v2", "/adsb/v1"}
+	tests := []struct {
+		name    string
+		given   string
+		want    protocol.ID
+		wantErr bool
+	}{
+		{"default", "", "nrn-nodered/v2", false},
+		{"primary", "nrn-nodered/v2", "nrn-nodered/v2", false},
+		{"additional", "/adsb/v1", "/adsb/v1", false},
+		{"not served", "/other/v1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := served.resolve(tt.given)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolve(%q) = %q, want %q", tt.given, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPinnedFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		pinned protocol.ID
+		filter *SubscriptionFilter
+		want   *SubscriptionFilter
+	}{
+		{"not pinned", "", &SubscriptionFilter{Types: []string{"p2p"}}, &SubscriptionFilter{Types: []string{"p2p"}}},
+		{"not pinned without filter", "", nil, nil},
+		{"pinned without filter", "/adsb/v1", nil, &SubscriptionFilter{Protocols: []string{"/adsb/v1"}}},
+		{"pinned keeps the other lists", "/adsb/v1", &SubscriptionFilter{Types: []string{"p2p"}, PublicKeys: []string{"03aa"}}, &SubscriptionFilter{Types: []string{"p2p"}, PublicKeys: []string{"03aa"}, Protocols: []string{"/adsb/v1"}}},
+		{"pinned overrides protocols", "/adsb/v1", &SubscriptionFilter{Protocols: []string{"nrn-nodered/v2"}}, &SubscriptionFilter{Protocols: []string{"/adsb/v1"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var original SubscriptionFilter
+			if tt.filter != nil {
+				original = *tt.filter
+			}
+			client := &Client{protocol: tt.pinned}
+			if got := client.pinnedFilter(tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("pinnedFilter = %+v, want %+v", got, tt.want)
+			}
+			if tt.filter != nil && !reflect.DeepEqual(*tt.filter, original) {
+				t.Errorf("pinnedFilter changed the given filter to %+v", *tt.filter)
+			}
+		})
+	}
+}
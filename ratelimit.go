@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"golang.org/x/time/rate"
+)
+
+// newRateLimiter returns a token bucket refilled at perSecond tokens per second holding up to burst tokens,
+// or nil when perSecond is 0, which disables the limit
+func newRateLimiter(perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(perSecond), burst)
+}
+
+// takeToken takes one token from the bucket. When the bucket is empty it takes nothing and
+// returns how long the caller should wait before retrying. A nil limiter always allows.
+func takeToken(limiter *rate.Limiter) (time.Duration, bool) {
+	if limiter == nil {
+		return 0, true
+	}
+	reservation := limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return delay, false
+	}
+	return 0, true
+}
+
+// peerRateLimiter holds one token bucket per target peer, shared by every client that sends to that peer.
+// Buckets are only created for peers the node has a buffer for, and dropped when the peer disconnects.
+type peerRateLimiter struct {
+	perSecond float64
+	burst     int
+	mu        sync.Mutex
+	limiters  map[peer.ID]*rate.Limiter
+}
+
+// newPeerRateLimiter returns the per-peer limits, disabled when perSecond is 0
+func newPeerRateLimiter(perSecond float64, burst int) *peerRateLimiter {
+	return &peerRateLimiter{perSecond: perSecond, burst: burst, limiters: make(map[peer.ID]*rate.Limiter)}
+}
+
+// take takes one token from the peer's bucket, see takeToken
+func (p *peerRateLimiter) take(peerID peer.ID) (time.Duration, bool) {
+	if p.perSecond <= 0 {
+		return 0, true
+	}
+	p.mu.Lock()
+	limiter, exists := p.limiters[peerID]
+	if !exists {
+		limiter = newRateLimiter(p.perSecond, p.burst)
+		p.limiters[peerID] = limiter
+	}
+	p.mu.Unlock()
+	return takeToken(limiter)
+}
+
+// forget drops the peer's bucket
+func (p *peerRateLimiter) forget(peerID peer.ID) {
+	p.mu.Lock()
+	delete(p.limiters, peerID)
+	p.mu.Unlock()
+}
+
+// watchDisconnects drops the bucket of every peer whose last connection closes, until ctx ends
+func (p *peerRateLimiter) watchDisconnects(ctx context.Context, h host.Host) {
+	if p.perSecond <= 0 {
+		return
+	}
+	watcher := &network.NotifyBundle{
+		DisconnectedF: func(n network.Network, conn network.Conn) {
+			if n.Connectedness(conn.RemotePeer()) != network.Connected {
+				p.forget(conn.RemotePeer())
+			}
+		},
+	}
+	h.Network().Notify(watcher)
+	go func() {
+		<-ctx.Done()
+		h.Network().StopNotify(watcher)
+	}()
+}
+
+// callerPruneThreshold is how many caller buckets are kept before idle ones are dropped
+const callerPruneThreshold = 1024
+
+// callerRateLimiter holds one token bucket per HTTP caller, keyed by the remote host, so one busy caller
+// cannot use up the sends of the others
+type callerRateLimiter struct {
+	perSecond float64
+	burst     int
+	mu        sync.Mutex
+	limiters  map[string]*rate.Limiter
+}
+
+// newCallerRateLimiter returns the per-caller limits, disabled when perSecond is 0
+func newCallerRateLimiter(perSecond float64, burst int) *callerRateLimiter {
+	return &callerRateLimiter{perSecond: perSecond, burst: burst, limiters: make(map[string]*rate.Limiter)}
+}
+
+// take takes one token from the bucket of the caller at remoteAddr, see takeToken. Callers without a host,
+// such as those on a Unix socket, share one bucket.
+func (c *callerRateLimiter) take(remoteAddr string) (time.Duration, bool) {
+	if c.perSecond <= 0 {
+		return 0, true
+	}
+	caller, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		caller = remoteAddr
+	}
+	c.mu.Lock()
+	limiter, exists := c.limiters[caller]
+	if !exists {
+		if len(c.limiters) >= callerPruneThreshold {
+			c.pruneIdle()
+		}
+		limiter = newRateLimiter(c.perSecond, c.burst)
+		c.limiters[caller] = limiter
+	}
+	c.mu.Unlock()
+	return takeToken(limiter)
+}
+
+// pruneIdle drops the buckets that have refilled completely, which behave the same as new ones.
+// The caller holds c.mu.
+func (c *callerRateLimiter) pruneIdle() {
+	for caller, limiter := range c.limiters {
+		if limiter.Tokens() >= float64(limiter.Burst()) {
+			delete(c.limiters, caller)
+		}
+	}
+}
+
+// rateLimitedMessage is the error sent back when a send exceeds a rate limit
+func rateLimitedMessage(scope string, retryAfter time.Duration) WSMessage {
+	return WSMessage{
+		Type:         "error",
+		Data:         fmt.Sprintf("Rate limit exceeded for %s, retry after %s", scope, retryAfter.Round(time.Millisecond)),
+		Timestamp:    time.Now().UnixMilli(),
+		Error:        "RATE_LIMITED",
+		RetryAfterMs: retryAfter.Milliseconds() + 1,
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+func TestTakeToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		perSecond float64
+		burst     int
+		takes     int
+		allowed   int
+	}{
+		{"unlimited", 0, 0, 100, 100},
+		{"within the burst", 1, 5, 5, 5},
+		{"over the burst", 1, 5, 8, 5},
+		{"burst below one", 1, 0, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(tt.perSecond, tt.burst)
+			allowed := 0
+			for i := 0; i < tt.takes; i++ {
+				retryAfter, ok := takeToken(limiter)
+				switch {
+				case ok:
+					allowed++
+				case retryAfter <= 0:
+					t.Errorf("take %d refused without a retry delay", i)
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("%d of %d takes allowed, want %d", allowed, tt.takes, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestPeerRateLimiter(t *testing.T) {
+	first, second := peer.ID("first"), peer.ID("second")
+	tests := []struct {
+		name      string
+		perSecond float64
+		buckets   int
+	}{
+		{"disabled", 0, 0},
+		{"enabled", 1, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits := newPeerRateLimiter(tt.perSecond, 1)
+			for _, peerID := range []peer.ID{first, second} {
+				if _, ok := limits.take(peerID); !ok {
+					t.Errorf("first send to %s refused", peerID)
+				}
+			}
+			if len(limits.limiters) != tt.buckets {
+				t.Fatalf("%d buckets, want %d", len(limits.limiters), tt.buckets)
+			}
+			if tt.perSecond == 0 {
+				return
+			}
+
+			if _, ok := limits.take(first); ok {
+				t.Errorf("send over the burst to %s allowed", first)
+			}
+			limits.forget(first)
+			if _, ok := limits.take(first); !ok {
+				t.Errorf("send to %s refused after its bucket was dropped", first)
+			}
+			if _, ok := limits.take(second); ok {
+				t.Errorf("bucket of %s dropped with the one of %s", second, first)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// httpStatus maps a wrapper error code to the HTTP status the REST endpoints answer with
+func httpStatus(code string) int {
+	switch code {
+	case "PARSE_ERROR", "INVALID_DATA", "MISSING_PUBLIC_KEY", "INVALID_PUBLIC_KEY", "PEER_ID_DECODE_ERROR", "INVALID_PROTOCOL":
+		return http.StatusBadRequest
+	case "UNKNOWN_COMMAND", "PEER_NOT_FOUND":
+		return http.StatusNotFound
+	case "BUYER_ONLY_OPERATION", "ROLE_NOT_ACTIVE":
+		return http.StatusConflict
+	case "MESSAGE_TOO_LARGE":
+		return http.StatusRequestEntityTooLarge
+	case "RATE_LIMITED":
+		return http.StatusTooManyRequests
+	case "REPLACE_ERROR", "SEND_ERROR":
+		return http.StatusBadGateway
+	case "NO_ADDRESSES", "SHUTTING_DOWN":
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeReply writes the reply to a REST request as JSON, with the HTTP status derived from its error code
+func writeReply(w http.ResponseWriter, reply WSMessage) {
+	status := http.StatusOK
+	if reply.Type == "error" {
+		status = httpStatus(reply.Error)
+		if reply.RetryAfterMs > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt((reply.RetryAfterMs+999)/1000, 10))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// allowMethod answers 405 unless the request uses the given method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// runCommand hands a command to the role's internal command handler and waits for its reply.
+// It gives up when the HTTP client goes away.
+func runCommand(r *http.Request, commands chan ClientMessage, msg WSMessage) (WSMessage, error) {
+	replies := make(chan WSMessage, 1)
+	req := ClientMessage{Message: msg, Respond: func(reply WSMessage) {
+		replies <- reply
+	}}
+
+	select {
+	case commands <- req:
+	case <-r.Context().Done():
+		return WSMessage{}, r.Context().Err()
+	}
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-r.Context().Done():
+		return WSMessage{}, r.Context().Err()
+	}
+}
+
+// handlePeersREST serves GET /buyer/peers and /seller/peers, the REST form of showCurrentPeers
+func handlePeersREST(w http.ResponseWriter, r *http.Request, commands chan ClientMessage) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	reply, err := runCommand(r, commands, WSMessage{Type: "showCurrentPeers", Timestamp: time.Now().UnixMilli()})
+	if err != nil {
+		log.Printf("Gave up on %s for %s: %v", r.URL.Path, r.RemoteAddr, err)
+		return
+	}
+	writeReply(w, reply)
+}
+
+// handleSellersREST serves PUT /buyer/sellers, the REST form of replaceSellers. The body is a ReplaceSellersRequest.
+func handleSellersREST(w http.ResponseWriter, r *http.Request, commands chan ClientMessage) {
+	if !allowMethod(w, r, http.MethodPut) {
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, *CommandsMaxPayloadBytes))
+	if err != nil {
+		reply := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Error reading request body: %v", err),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "PARSE_ERROR",
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			reply.Data = fmt.Sprintf("Request body exceeds the limit of %d bytes", tooLarge.Limit)
+			reply.Error = "MESSAGE_TOO_LARGE"
+		}
+		writeReply(w, reply)
+		return
+	}
+
+	reply, err := runCommand(r, commands, WSMessage{Type: "replaceSellers", Data: string(body), Timestamp: time.Now().UnixMilli()})
+	if err != nil {
+		log.Printf("Gave up on %s for %s: %v", r.URL.Path, r.RemoteAddr, err)
+		return
+	}
+	writeReply(w, reply)
+}
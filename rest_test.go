@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answerCommands stands in for a role's command handler: it answers every command with reply and passes
+// the commands it received on to the returned channel
+func answerCommands(t *testing.T, reply WSMessage) (chan ClientMessage, <-chan WSMessage) {
+	t.Helper()
+	commands := make(chan ClientMessage)
+	received := make(chan WSMessage, 1)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case req := <-commands:
+				received <- req.Message
+				req.Respond(reply)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return commands, received
+}
+
+// answerSends stands in for the P2P send loop, answering every send with reply
+func answerSends(t *testing.T, reply WSMessage) *SendQueue {
+	t.Helper()
+	queue := NewSendQueue()
+	go func() {
+		for msg := range queue.Messages() {
+			msg.Respond(reply)
+			queue.Done()
+		}
+	}()
+	return queue
+}
+
+// checkReply checks the status and the Retry-After header of a response and decodes its body
+func checkReply(t *testing.T, w *httptest.ResponseRecorder, status int, retryAfter string) WSMessage {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+	if got := w.Header().Get("Retry-After"); got != retryAfter {
+		t.Errorf("Retry-After = %q, want %q", got, retryAfter)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("Content-Type = %q, want application/json", contentType)
+	}
+	var reply WSMessage
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatalf("decoding the reply: %v", err)
+	}
+	return reply
+}
+
+func TestPeersREST(t *testing.T) {
+	tests := []struct {
+		name   string
+		reply  WSMessage
+		status int
+	}{
+		{"peers", WSMessage{Type: "currentPeers", Data: []string{}}, http.StatusOK},
+		{"role not active", WSMessage{Type: "error", Data: "Buyer role is not active", Error: "ROLE_NOT_ACTIVE"}, http.StatusConflict},
+		{"unknown error", WSMessage{Type: "error", Data: "Something new", Error: "SOMETHING_NEW"}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, received := answerCommands(t, tt.reply)
+			w := httptest.NewRecorder()
+			handlePeersREST(w, httptest.NewRequest(http.MethodGet, "/buyer/peers", nil), commands)
+
+			reply := checkReply(t, w, tt.status, "")
+			if reply.Type != tt.reply.Type || reply.Error != tt.reply.Error {
+				t.Errorf("reply = %+v, want %+v", reply, tt.reply)
+			}
+			if command := <-received; command.Type != "showCurrentPeers" {
+				t.Errorf("command type = %q, want showCurrentPeers", command.Type)
+			}
+		})
+	}
+
+	t.Run("wrong method", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handlePeersREST(w, httptest.NewRequest(http.MethodPost, "/buyer/peers", nil), nil)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodGet {
+			t.Errorf("status %d, Allow %q, want %d, GET", w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func TestSellersREST(t *testing.T) {
+	const body = `{"sellerPublicKeys": ["02ab"]}`
+	tests := []struct {
+		name   string
+		reply  WSMessage
+		status int
+	}{
+		{"replaced", WSMessage{Type: "success", Data: "Sellers replaced"}, http.StatusOK},
+		{"parse error", WSMessage{Type: "error", Data: "Error parsing sellers", Error: "PARSE_ERROR"}, http.StatusBadRequest},
+		{"replace failed", WSMessage{Type: "error", Data: "Error replacing sellers", Error: "REPLACE_ERROR"}, http.StatusBadGateway},
+		{"no addresses", WSMessage{Type: "error", Data: "No addresses", Error: "NO_ADDRESSES"}, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, received := answerCommands(t, tt.reply)
+			w := httptest.NewRecorder()
+			handleSellersREST(w, httptest.NewRequest(http.MethodPut, "/buyer/sellers", strings.NewReader(body)), commands)
+
+			reply := checkReply(t, w, tt.status, "")
+			if reply.Type != tt.reply.Type || reply.Error != tt.reply.Error || reply.Data != tt.reply.Data {
+				t.Errorf("reply = %+v, want %+v", reply, tt.reply)
+			}
+			command := <-received
+			if command.Type != "replaceSellers" || command.Data != body {
+				t.Errorf("command = %+v, want replaceSellers with the request body as data", command)
+			}
+		})
+	}
+
+	t.Run("body too large", func(t *testing.T) {
+		defer func(limit int64) { *CommandsMaxPayloadBytes = limit }(*CommandsMaxPayloadBytes)
+		*CommandsMaxPayloadBytes = 8
+		w := httptest.NewRecorder()
+		handleSellersREST(w, httptest.NewRequest(http.MethodPut, "/buyer/sellers", strings.NewReader(body)), nil)
+		if reply := checkReply(t, w, http.StatusRequestEntityTooLarge, ""); reply.Error != "MESSAGE_TOO_LARGE" {
+			t.Errorf("error = %q, want MESSAGE_TOO_LARGE", reply.Error)
+		}
+	})
+
+	t.Run("wrong method", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleSellersREST(w, httptest.NewRequest(http.MethodGet, "/buyer/sellers", nil), nil)
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPut {
+			t.Errorf("status %d, Allow %q, want %d, PUT", w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func TestSendREST(t *testing.T) {
+	const body = `{"publicKey": "02ab", "data": "hello"}`
+	tests := []struct {
+		name       string
+		reply      WSMessage
+		status     int
+		retryAfter string
+	}{
+		{"sent", WSMessage{Type: "success", Data: "Message sent"}, http.StatusOK, ""},
+		{"invalid public key", WSMessage{Type: "error", Data: "Invalid public key", Error: "INVALID_PUBLIC_KEY"}, http.StatusBadRequest, ""},
+		{"peer not found", WSMessage{Type: "error", Data: "No stream to peer", Error: "PEER_NOT_FOUND"}, http.StatusNotFound, ""},
+		{"payload too large", WSMessage{Type: "error", Data: "Payload too large", Error: "MESSAGE_TOO_LARGE"}, http.StatusRequestEntityTooLarge, ""},
+		{"rate limited", rateLimitedMessage("peer 02ab", 1500*time.Millisecond), http.StatusTooManyRequests, "2"},
+		{"send failed", WSMessage{Type: "error", Data: "Error writing to stream", Error: "SEND_ERROR"}, http.StatusBadGateway, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := answerSends(t, tt.reply)
+			w := httptest.NewRecorder()
+			handleSendHTTP(w, httptest.NewRequest(http.MethodPost, "/buyer/p2p/send", strings.NewReader(body)), queue, newCallerRateLimiter(0, 0))
+
+			reply := checkReply(t, w, tt.status, tt.retryAfter)
+			if reply.Type != tt.reply.Type || reply.Error != tt.reply.Error || reply.RetryAfterMs != tt.reply.RetryAfterMs {
+				t.Errorf("reply = %+v, want %+v", reply, tt.reply)
+			}
+		})
+	}
+
+	t.Run("malformed body", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleSendHTTP(w, httptest.NewRequest(http.MethodPost, "/buyer/p2p/send", strings.NewReader("{")), nil, newCallerRateLimiter(0, 0))
+		if reply := checkReply(t, w, http.StatusBadRequest, ""); reply.Error != "PARSE_ERROR" {
+			t.Errorf("error = %q, want PARSE_ERROR", reply.Error)
+		}
+	})
+
+	t.Run("shutting down", func(t *testing.T) {
+		queue := NewSendQueue()
+		if err := queue.Drain(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		handleSendHTTP(w, httptest.NewRequest(http.MethodPost, "/buyer/p2p/send", strings.NewReader(body)), queue, newCallerRateLimiter(0, 0))
+		if reply := checkReply(t, w, http.StatusServiceUnavailable, ""); reply.Error != "SHUTTING_DOWN" {
+			t.Errorf("error = %q, want SHUTTING_DOWN", reply.Error)
+		}
+	})
+
+	t.Run("wrong method", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handleSendHTTP(w, httptest.NewRequest(http.MethodGet, "/buyer/p2p/send", nil), nil, newCallerRateLimiter(0, 0))
+		if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("status %d, Allow %q, want %d, POST", w.Code, w.Header().Get("Allow"), http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+)
+
+// RoleInfo is the body served by /role
+type RoleInfo struct {
+	Role      string   `json:"role"`
+	Endpoints []string `json:"endpoints"`
+}
+
+// activeRole returns the role this process runs as, "buyer" or "seller", as set by --buyer-or-seller.
+// LaunchSDK only runs the callbacks of that role, so only its endpoints have anyone reading their channels.
+func activeRole() string {
+	return *commonlib.BuyerOrSellerFlag
+}
+
+// roleEndpoints lists the endpoints served for a role
+func roleEndpoints(role string) []string {
+	endpoints := []string{"/" + role + "/p2p", "/" + role + "/p2p/send", "/" + role + "/p2p/events", "/" + role + "/commands", "/" + role + "/peers"}
+	for _, path := range protocolPaths {
+		endpoints = append(endpoints, "/"+role+"/p2p/"+path.Name)
+	}
+	if role == "buyer" {
+		endpoints = append(endpoints, "/buyer/sellers")
+	}
+	return append(endpoints, "/rpc")
+}
+
+// requireRole rejects requests to an endpoint of a role this process does not run, before any WebSocket upgrade,
+// instead of accepting messages that nothing would ever read
+func requireRole(role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if active := activeRole(); active != role {
+			log.Printf("Rejected request from %s to %s: this node runs as %q", r.RemoteAddr, r.URL.Path, active)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(WSMessage{
+				Type:      "error",
+				Data:      fmt.Sprintf("This node runs as %q, %s endpoints are not active", active, role),
+				Timestamp: time.Now().UnixMilli(),
+				Error:     "ROLE_NOT_ACTIVE",
+			})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleRole reports which role this process is running and the endpoints that accept traffic
+func handleRole(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	role := activeRole()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(RoleInfo{Role: role, Endpoints: roleEndpoints(role)})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// JSON-RPC 2.0 error codes. Failures reported by the node itself share rpcServerError and carry the
+// wrapper's error code (PEER_NOT_FOUND, RATE_LIMITED...) in the error data.
+const (
+	rpcParseError     = -32700
+	rpcInvalidRequest = -32600
+	rpcMethodNotFound = -32601
+	rpcInvalidParams  = -32602
+	rpcInternalError  = -32603
+	rpcServerError    = -32000
+)
+
+// rpcResponseType marks a queued message whose Data is an RPCResponse, written to the client as it is
+const rpcResponseType = "rpcResponse"
+
+// RPCRequest is a JSON-RPC 2.0 request read from an /rpc client
+type RPCRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"` // absent for notifications, which are never answered
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+// RPCResponse is the answer to an RPCRequest; exactly one of Result and Error is set
+type RPCResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError is the error object of a failed request
+type RPCError struct {
+	Code    int           `json:"code"`
+	Message string        `json:"message"`
+	Data    *RPCErrorData `json:"data,omitempty"`
+}
+
+// RPCErrorData carries the wrapper's error code, the same one the other endpoints put in WSMessage.Error
+type RPCErrorData struct {
+	Error        string `json:"error"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+}
+
+// RPCNotification delivers inbound traffic (p2p, topic) and session events (session, gap, lag) to /rpc clients.
+// The method is the message type and the params are the message itself.
+type RPCNotification struct {
+	JSONRPC string    `json:"jsonrpc"`
+	Method  string    `json:"method"`
+	Params  WSMessage `json:"params"`
+}
+
+// rpcFrame turns a queued message into what is written to a JSON-RPC client
+func rpcFrame(msg WSMessage) interface{} {
+	if msg.Type == rpcResponseType {
+		return msg.Data
+	}
+	return RPCNotification{JSONRPC: "2.0", Method: msg.Type, Params: msg}
+}
+
+// rpcErrorCode maps a wrapper error code to a JSON-RPC error code
+func rpcErrorCode(code string) int {
+	switch code {
+	case "PARSE_ERROR", "INVALID_DATA", "MISSING_PUBLIC_KEY", "INVALID_PUBLIC_KEY", "PEER_ID_DECODE_ERROR", "INVALID_PROTOCOL", "MESSAGE_TOO_LARGE":
+		return rpcInvalidParams
+	case "UNKNOWN_COMMAND":
+		return rpcMethodNotFound
+	default:
+		return rpcServerError
+	}
+}
+
+// rpcErrorResponse builds a response carrying a protocol level error
+func rpcErrorResponse(id json.RawMessage, code int, message string) RPCResponse {
+	return RPCResponse{JSONRPC: "2.0", ID: id, Error: &RPCError{Code: code, Message: message}}
+}
+
+// rpcResponse converts the reply the node produced for a request into its JSON-RPC response
+func rpcResponse(id json.RawMessage, reply WSMessage) RPCResponse {
+	if reply.Type == "error" {
+		return RPCResponse{JSONRPC: "2.0", ID: id, Error: &RPCError{
+			Code:    rpcErrorCode(reply.Error),
+			Message: fmt.Sprint(reply.Data),
+			Data:    &RPCErrorData{Error: reply.Error, RetryAfterMs: reply.RetryAfterMs},
+		}}
+	}
+	result, err := json.Marshal(reply.Data)
+	if err != nil {
+		return rpcErrorResponse(id, rpcInternalError, fmt.Sprintf("Error encoding result: %v", err))
+	}
+	return RPCResponse{JSONRPC: "2.0", ID: id, Result: result}
+}
+
+// deliverRPC queues a response for a JSON-RPC client. Responses are never dropped by the slow consumer policy,
+// and are written ahead of queued notifications.
+func deliverRPC(client *Client, response RPCResponse) {
+	client.respond(WSMessage{
+		Type:      rpcResponseType,
+		Data:      response,
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
+
+// decodeRPCParams decodes by-name params into v
+func decodeRPCParams(params json.RawMessage, v interface{}) error {
+	if len(params) == 0 {
+		return errors.New("missing params")
+	}
+	return json.Unmarshal(params, v)
+}
+
+// handleRPCWebSocket serves the JSON-RPC 2.0 endpoint. The connection is attached to the hub like a P2P client,
+// so inbound traffic reaches it as notifications, and its requests run on the same send queue and command
+// handler as the /p2p and /commands endpoints.
+func handleRPCWebSocket(w http.ResponseWriter, r *http.Request, hub *Hub, wsToP2P *SendQueue, commands chan ClientMessage) {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: checkOrigin,
+	}
+
+	upgraded, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading connection: %v", err)
+		return
+	}
+	conn := newWSConn(upgraded, hub.name+" rpc", *WSMaxFrameBytes)
+	defer conn.finish()
+
+	client := hub.RegisterRPC(conn)
+	defer hub.Unregister(client)
+	client.sendLimit = newRateLimiter(*P2PClientRate, *P2PClientBurst)
+
+	done := make(chan struct{})
+
+	// Handle incoming requests
+	go func() {
+		defer close(done)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				log.Printf("Error reading message: %v", err)
+				return
+			}
+			handleRPCRequest(client, data, wsToP2P, commands)
+		}
+	}()
+
+	// Ping the client and watch for idle connections
+	go conn.keepalive(done)
+
+	// Send responses and notifications to client
+	client.writePump(done)
+}
+
+// handleRPCRequest dispatches one JSON-RPC request. The methods map onto the existing operations:
+// p2p.send onto a P2P send (params are a SendRequest), peers.list onto showCurrentPeers, node.info onto showSelfInfo,
+// sellers.replace onto replaceSellers, and subscribe/unsubscribe onto the subscription filter.
+func handleRPCRequest(client *Client, data []byte, wsToP2P *SendQueue, commands chan ClientMessage) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		deliverRPC(client, rpcErrorResponse(nil, rpcInvalidRequest, "Batch requests are not supported"))
+		return
+	}
+
+	var req RPCRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		deliverRPC(client, rpcErrorResponse(nil, rpcParseError, fmt.Sprintf("Error parsing request: %v", err)))
+		return
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		deliverRPC(client, rpcErrorResponse(req.ID, rpcInvalidRequest, `Requests must set "jsonrpc": "2.0" and a method`))
+		return
+	}
+
+	request := ClientMessage{
+		Client: client,
+		Respond: func(reply WSMessage) {
+			if len(req.ID) > 0 {
+				deliverRPC(client, rpcResponse(req.ID, reply))
+			}
+		},
+	}
+
+	switch req.Method {
+	case "p2p.send":
+		var params SendRequest
+		if err := decodeRPCParams(req.Params, &params); err != nil {
+			request.Reply(WSMessage{
+				Type:      "error",
+				Data:      fmt.Sprintf("Error parsing p2p.send params: %v", err),
+				Timestamp: time.Now().UnixMilli(),
+				Error:     "PARSE_ERROR",
+			})
+			return
+		}
+		request.Message = WSMessage{
+			Type:       "p2p",
+			Data:       params.Data,
+			Timestamp:  time.Now().UnixMilli(),
+			PublicKey:  params.PublicKey,
+			PublicKeys: params.PublicKeys,
+			Protocol:   params.Protocol,
+		}
+		if !wsToP2P.Push(request) {
+			request.Reply(WSMessage{
+				Type:      "error",
+				Data:      "The node is shutting down and no longer sends messages",
+				Timestamp: time.Now().UnixMilli(),
+				Error:     "SHUTTING_DOWN",
+			})
+		}
+	case "peers.list":
+		request.Message = WSMessage{Type: "showCurrentPeers", Timestamp: time.Now().UnixMilli()}
+		submitCommand(commands, request)
+	case "node.info":
+		request.Message = WSMessage{Type: "showSelfInfo", Timestamp: time.Now().UnixMilli()}
+		submitCommand(commands, request)
+	case "sellers.replace":
+		request.Message = WSMessage{Type: "replaceSellers", Data: string(req.Params), Timestamp: time.Now().UnixMilli()}
+		submitCommand(commands, request)
+	case "subscribe", "unsubscribe":
+		request.Message = WSMessage{Type: req.Method, Data: string(req.Params), Timestamp: time.Now().UnixMilli()}
+		request.Respond(handleSubscription(client, request.Message))
+	default:
+		request.Reply(WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Unknown method: %s", req.Method),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "UNKNOWN_COMMAND",
+		})
+	}
+}
+
+// submitCommand hands a request to the command handler. The connection's reader waits while the handler is busy,
+// but gives up when the client goes away, and answers SHUTTING_DOWN once the node stops and nothing handles commands.
+func submitCommand(commands chan ClientMessage, request ClientMessage) {
+	select {
+	case commands <- request:
+	case <-request.Client.done:
+	case <-appCtx.Done():
+		request.Reply(WSMessage{
+			Type:      "error",
+			Data:      "The node is shutting down and no longer handles commands",
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "SHUTTING_DOWN",
+		})
+	}
+}
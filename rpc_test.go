@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// takeRPCResponses returns the JSON-RPC responses queued for client, as written to the connection
+func takeRPCResponses(t *testing.T, client *Client) []RPCResponse {
+	t.Helper()
+	client.responsesMu.Lock()
+	queued := client.responses
+	client.responses = nil
+	client.responsesMu.Unlock()
+
+	responses := make([]RPCResponse, 0, len(queued))
+	for _, msg := range queued {
+		encoded, err := json.Marshal(rpcFrame(msg))
+		if err != nil {
+			t.Fatalf("encoding the response: %v", err)
+		}
+		var response RPCResponse
+		if err := json.Unmarshal(encoded, &response); err != nil {
+			t.Fatalf("decoding the response %s: %v", encoded, err)
+		}
+		responses = append(responses, response)
+	}
+	return responses
+}
+
+func TestHandleRPCRequest(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   string
+		sendReply WSMessage // what the send loop answers to p2p.send
+		id        string
+		result    string
+		code      int
+		errorCode string
+	}{
+		{"parse error", `{"jsonrpc": "2.0", "method": `, WSMessage{}, "null", "", rpcParseError, ""},
+		{"batch", `[{"jsonrpc": "2.0", "id": 1, "method": "node.info"}]`, WSMessage{}, "null", "", rpcInvalidRequest, ""},
+		{"wrong version", `{"jsonrpc": "1.0", "id": 1, "method": "node.info"}`, WSMessage{}, "1", "", rpcInvalidRequest, ""},
+		{"unknown method", `{"jsonrpc": "2.0", "id": 2, "method": "node.reboot"}`, WSMessage{}, "2", "", rpcMethodNotFound, "UNKNOWN_COMMAND"},
+		{"invalid params", `{"jsonrpc": "2.0", "id": "a", "method": "p2p.send", "params": [1]}`, WSMessage{}, `"a"`, "", rpcInvalidParams, "PARSE_ERROR"},
+		{"missing params", `{"jsonrpc": "2.0", "id": 3, "method": "p2p.send"}`, WSMessage{}, "3", "", rpcInvalidParams, "PARSE_ERROR"},
+		{"invalid subscribe params", `{"jsonrpc": "2.0", "id": 4, "method": "subscribe", "params": {"types": 1}}`, WSMessage{}, "4", "", rpcInvalidParams, "PARSE_ERROR"},
+		{"sent", `{"jsonrpc": "2.0", "id": 5, "method": "p2p.send", "params": {"publicKey": "02ab", "data": "hello"}}`, WSMessage{Type: "success", Data: "Message sent"}, "5", `"Message sent"`, 0, ""},
+		{"send failed", `{"jsonrpc": "2.0", "id": 6, "method": "p2p.send", "params": {"publicKey": "02ab", "data": "hello"}}`, WSMessage{Type: "error", Data: "No stream to peer", Error: "PEER_NOT_FOUND"}, "6", "", rpcServerError, "PEER_NOT_FOUND"},
+		{"subscribed", `{"jsonrpc": "2.0", "id": 7, "method": "subscribe", "params": {"types": ["lag"]}}`, WSMessage{}, "7", `{"types":["lag"]}`, 0, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hub := NewHub("test", 4, PolicyDropNewest, 0, time.Minute, 0)
+			client := hub.RegisterRPC(testConn{})
+			defer hub.Unregister(client)
+
+			handleRPCRequest(client, []byte(tt.request), answerSends(t, tt.sendReply), nil)
+
+			responses := takeRPCResponses(t, client)
+			if len(responses) != 1 {
+				t.Fatalf("%d responses, want 1: %+v", len(responses), responses)
+			}
+			response := responses[0]
+			if response.JSONRPC != "2.0" {
+				t.Errorf("jsonrpc = %q, want 2.0", response.JSONRPC)
+			}
+			if string(response.ID) != tt.id {
+				t.Errorf("id = %s, want %s", response.ID, tt.id)
+			}
+			if string(response.Result) != tt.result {
+				t.Errorf("result = %s, want %s", response.Result, tt.result)
+			}
+			if tt.code == 0 {
+				if response.Error != nil {
+					t.Errorf("error = %+v, want none", response.Error)
+				}
+				return
+			}
+			if response.Error == nil {
+				t.Fatalf("no error, want code %d", tt.code)
+			}
+			if response.Error.Code != tt.code || response.Error.Message == "" {
+				t.Errorf("error = %+v, want code %d with a message", response.Error, tt.code)
+			}
+			if tt.errorCode == "" {
+				if response.Error.Data != nil {
+					t.Errorf("error data = %+v, want none", response.Error.Data)
+				}
+			} else if response.Error.Data == nil || response.Error.Data.Error != tt.errorCode {
+				t.Errorf("error data = %+v, want %s", response.Error.Data, tt.errorCode)
+			}
+		})
+	}
+}
+
+func TestHandleRPCNotification(t *testing.T) {
+	hub := NewHub("test", 4, PolicyDropNewest, 0, time.Minute, 0)
+	client := hub.RegisterRPC(testConn{})
+	defer hub.Unregister(client)
+
+	handleRPCRequest(client, []byte(`{"jsonrpc": "2.0", "method": "subscribe", "params": {"types": ["lag"]}}`), nil, nil)
+	if filter := client.session.filter.Load(); filter == nil || len(filter.Types) != 1 || filter.Types[0] != "lag" {
+		t.Errorf("filter = %+v, want types [lag]", filter)
+	}
+	handleRPCRequest(client, []byte(`{"jsonrpc": "2.0", "method": "node.reboot"}`), nil, nil)
+
+	if responses := takeRPCResponses(t, client); len(responses) != 0 {
+		t.Errorf("notifications were answered: %+v", responses)
+	}
+}
+
+func TestRPCResponse(t *testing.T) {
+	id := json.RawMessage(`7`)
+	tests := []struct {
+		name   string
+		reply  WSMessage
+		result string
+		err    *RPCError
+	}{
+		{"success", WSMessage{Type: "success", Data: "Successfully sent message"}, `"Successfully sent message"`, nil},
+		{"structured result", WSMessage{Type: "sendResults", Data: []SendResult{{PublicKey: "03aa", Success: true, Message: "sent"}}}, `[{"publicKey":"03aa","success":true,"message":"sent"}]`, nil},
+		{"error", WSMessage{Type: "error", Data: "No buffer found", Error: "PEER_NOT_FOUND"}, "", &RPCError{Code: rpcServerError, Message: "No buffer found", Data: &RPCErrorData{Error: "PEER_NOT_FOUND"}}},
+		{"rate limited", WSMessage{Type: "error", Data: "Rate limit exceeded", Error: "RATE_LIMITED", RetryAfterMs: 250}, "", &RPCError{Code: rpcServerError, Message: "Rate limit exceeded", Data: &RPCErrorData{Error: "RATE_LIMITED", RetryAfterMs: 250}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := rpcResponse(id, tt.reply)
+			if string(response.ID) != "7" || response.JSONRPC != "2.0" {
+				t.Errorf("response id %s, version %q, want 7 and 2.0", response.ID, response.JSONRPC)
+			}
+			if string(response.Result) != tt.result {
+				t.Errorf("result = %s, want %s", response.Result, tt.result)
+			}
+			got, _ := json.Marshal(response.Error)
+			want, _ := json.Marshal(tt.err)
+			if string(got) != string(want) {
+				t.Errorf("error = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestRPCResponsesBypassSlowConsumerPolicy(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{PolicyBlock, PolicyDropOldest, PolicyDropNewest, PolicyDisconnect} {
+		t.Run(string(policy), func(t *testing.T) {
+			hub := NewHub("test", 1, policy, 4, time.Minute, 0)
+			client := hub.RegisterRPC(testConn{})
+			defer hub.Unregister(client)
+
+			hub.Broadcast(WSMessage{Type: "p2p", Data: "fills the queue"})
+			for i := 0; i < 3; i++ {
+				deliverRPC(client, rpcResponse(json.RawMessage(`1`), WSMessage{Type: "success", Data: "ok"}))
+			}
+
+			select {
+			case <-client.done:
+				t.Fatal("client was disconnected")
+			default:
+			}
+			if dropped := client.dropped.Load(); dropped != 0 {
+				t.Errorf("%d messages dropped", dropped)
+			}
+			if len(client.responses) != 3 {
+				t.Errorf("%d responses queued, want 3", len(client.responses))
+			}
+		})
+	}
+}
+
+func TestRegisterRPC(t *testing.T) {
+	hub := NewHub("test", 4, PolicyDropNewest, 4, time.Minute, 0)
+	client := hub.RegisterRPC(testConn{})
+	if len(client.pending) != 0 {
+		t.Errorf("JSON-RPC client starts with %d pending messages, want none", len(client.pending))
+	}
+
+	hub.Broadcast(WSMessage{Type: "p2p", Data: "hello"})
+	if msg := <-client.send; msg.Data != "hello" {
+		t.Errorf("received %+v", msg)
+	}
+	if client.session.replay.count != 0 {
+		t.Errorf("JSON-RPC session kept %d messages for replay", client.session.replay.count)
+	}
+
+	hub.Unregister(client)
+	hub.mu.RLock()
+	_, kept := hub.sessions[client.session.token]
+	hub.mu.RUnlock()
+	if kept {
+		t.Errorf("JSON-RPC session kept after its client unregistered")
+	}
+}
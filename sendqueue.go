@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// SendQueue carries messages from WebSocket clients to the P2P send loop. It counts messages that were accepted
+// but not sent yet, so that shutdown can wait for them to be flushed.
+type SendQueue struct {
+	messages chan ClientMessage
+	mu       sync.Mutex
+	closed   bool
+	pending  sync.WaitGroup
+}
+
+// NewSendQueue creates an open, unbuffered send queue
+func NewSendQueue() *SendQueue {
+	return &SendQueue{messages: make(chan ClientMessage)}
+}
+
+// Push hands a message to the send loop. It returns false without queueing when the queue is draining.
+func (q *SendQueue) Push(msg ClientMessage) bool {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return false
+	}
+	q.pending.Add(1)
+	q.mu.Unlock()
+
+	q.messages <- msg
+	return true
+}
+
+// Messages is the channel the send loop reads from; it must call Done after handling each message
+func (q *SendQueue) Messages() <-chan ClientMessage {
+	return q.messages
+}
+
+// Done marks one message taken from Messages as handled
+func (q *SendQueue) Done() {
+	q.pending.Done()
+}
+
+// Drain stops the queue from accepting new messages and waits until every accepted message has been handled,
+// or until ctx ends
+func (q *SendQueue) Drain(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	flushed := make(chan struct{})
+	go func() {
+		q.pending.Wait()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
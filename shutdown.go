@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/libp2p/go-libp2p/core/host"
+)
+
+// appCtx is cancelled as the last step of a graceful shutdown. The role callbacks derive their context from it,
+// since the context the SDK hands them is never cancelled.
+var appCtx, cancelApp = context.WithCancel(context.Background())
+
+// stopStreams is closed when shutdown begins. Long-lived HTTP responses (event streams) end on it,
+// since the HTTP server's Shutdown waits for them, unlike for hijacked WebSocket connections.
+var stopStreams = make(chan struct{})
+
+// shutdownSignals receives SIGINT and SIGTERM for the graceful shutdown
+var shutdownSignals = make(chan os.Signal, 1)
+
+// sdkSignalSettle is how long after the role callback starts the signals are taken over a second time, in case
+// the callback ran before LaunchSDK installed its own handler
+const sdkSignalSettle = time.Second
+
+// sdkHost is the libp2p host of the running role, closed by the shutdown once the queued sends are flushed
+var sdkHost struct {
+	sync.Mutex
+	host host.Host
+}
+
+// withAppContext returns a context that is cancelled when either ctx or appCtx is
+func withAppContext(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	context.AfterFunc(appCtx, cancel)
+	return ctx
+}
+
+// takeOverShutdownSignals is called from the role callbacks. LaunchSDK installs a SIGINT/SIGTERM handler of its
+// own that closes the libp2p host right away, which would fail every queued send, so that handler is removed and
+// the signals go to the graceful shutdown alone. LaunchSDK installs its handler while starting the role, so the
+// callback may run first; the take-over is repeated once the SDK has settled.
+func takeOverShutdownSignals(h host.Host) {
+	sdkHost.Lock()
+	sdkHost.host = h
+	sdkHost.Unlock()
+
+	takeOver := func() {
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+		signal.Notify(shutdownSignals, syscall.SIGINT, syscall.SIGTERM)
+	}
+	takeOver()
+	time.AfterFunc(sdkSignalSettle, takeOver)
+}
+
+// shuttingDown reports whether the graceful shutdown has started
+func shuttingDown() bool {
+	select {
+	case <-stopStreams:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSDKHost closes the libp2p host of the running role, if it has started
+func closeSDKHost() {
+	sdkHost.Lock()
+	defer sdkHost.Unlock()
+	if sdkHost.host == nil {
+		return
+	}
+	if err := sdkHost.host.Close(); err != nil {
+		log.Printf("Error closing libp2p host: %v", err)
+	}
+}
+
+// gracefulShutdown stops the wrapper within --shutdown-timeout: it stops accepting new connections, flushes the
+// queued P2P sends, closes every WebSocket with "going away" and finally cancels the application context and
+// closes the libp2p host. A second signal during shutdown exits immediately.
+func gracefulShutdown(server *http.Server, queues ...*SendQueue) {
+	go func() {
+		sig := <-shutdownSignals
+		log.Printf("Received %s during shutdown, exiting immediately", sig)
+		os.Exit(1)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *ShutdownTimeout)
+	defer cancel()
+
+	log.Printf("Shutting down: no longer accepting connections")
+	close(stopStreams)
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error stopping HTTP server: %v", err)
+	}
+
+	log.Printf("Shutting down: flushing queued P2P sends")
+	for _, queue := range queues {
+		if err := queue.Drain(ctx); err != nil {
+			log.Printf("Gave up flushing queued P2P sends: %v", err)
+		}
+	}
+
+	log.Printf("Shutting down: closing WebSocket connections")
+	closeAllWSConns(websocket.CloseGoingAway, "server shutting down")
+	waitForWSConns(ctx)
+
+	log.Printf("Shutting down: stopping the SDK")
+	cancelApp()
+	closeSDKHost()
+	log.Printf("Shutdown complete")
+}
+
+// waitForWSConns waits until every WebSocket handler has finished, polling until ctx ends
+func waitForWSConns(ctx context.Context) {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for countWSConns() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("%d WebSocket connections still open at shutdown deadline", countWSConns())
+			return
+		case <-ticker.C:
+		}
+	}
+}
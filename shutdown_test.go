@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// TestDrainFlushesBeforeHostCloses runs the shutdown's flush against a real libp2p connection: sends already
+// queued when the drain starts reach the peer, and the host is only closed after the drain.
+func TestDrainFlushesBeforeHostCloses(t *testing.T) {
+	const protocolID = "/drain-test/v1"
+	const sends = 5
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sender, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	received := make(chan string, sends)
+	receiver.SetStreamHandler(protocolID, func(stream network.Stream) {
+		r := bufio.NewReader(stream)
+		for {
+			payload, err := readStreamFrame(r, 1024, nil)
+			if err != nil {
+				return
+			}
+			received <- string(payload)
+		}
+	})
+	if err := sender.Connect(ctx, peer.AddrInfo{ID: receiver.ID(), Addrs: receiver.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := sender.NewStream(ctx, receiver.ID(), protocolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sdkHost.Lock()
+	sdkHost.host = sender
+	sdkHost.Unlock()
+	defer func() {
+		sdkHost.Lock()
+		sdkHost.host = nil
+		sdkHost.Unlock()
+	}()
+
+	// A send loop that takes every message at once but is slow to send it, so the drain has to wait
+	queue := NewSendQueue()
+	var streamMu sync.Mutex
+	var repliesMu sync.Mutex
+	var replies []WSMessage
+	go func() {
+		for req := range queue.Messages() {
+			go func(req ClientMessage) {
+				defer queue.Done()
+				time.Sleep(50 * time.Millisecond)
+				streamMu.Lock()
+				_, err := stream.Write(encodeStreamFrame([]byte(fmt.Sprint(req.Message.Data))))
+				streamMu.Unlock()
+				reply := WSMessage{Type: "success"}
+				if err != nil {
+					reply = WSMessage{Type: "error", Data: err.Error(), Error: "SEND_ERROR"}
+				}
+				req.Reply(reply)
+			}(req)
+		}
+	}()
+
+	for i := 0; i < sends; i++ {
+		request := ClientMessage{
+			Message: WSMessage{Type: "p2p", Data: fmt.Sprintf("message %d", i)},
+			Respond: func(reply WSMessage) {
+				repliesMu.Lock()
+				replies = append(replies, reply)
+				repliesMu.Unlock()
+			},
+		}
+		if !queue.Push(request) {
+			t.Fatalf("send %d refused before the drain", i)
+		}
+	}
+
+	drainCtx, drainCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer drainCancel()
+	if err := queue.Drain(drainCtx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+	closeSDKHost()
+
+	if queue.Push(ClientMessage{Message: WSMessage{Type: "p2p"}}) {
+		t.Errorf("send accepted after the drain")
+	}
+	repliesMu.Lock()
+	defer repliesMu.Unlock()
+	if len(replies) != sends {
+		t.Fatalf("%d replies, want %d", len(replies), sends)
+	}
+	for _, reply := range replies {
+		if reply.Type != "success" {
+			t.Errorf("send failed: %+v", reply)
+		}
+	}
+	for i := 0; i < sends; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("peer received %d of %d sends", i, sends)
+		}
+	}
+}
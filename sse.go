@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// httpAddr is the remote address of an HTTP request, as reported by net/http
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+// sseConn is a Server-Sent Events stream attached to a hub like a WebSocket client. Every message is one event
+// whose data is the JSON message; sequenced messages carry the id "<session>:<seq>" for Last-Event-ID resume.
+type sseConn struct {
+	mu         sync.Mutex
+	w          io.Writer
+	controller *http.ResponseController
+	remoteAddr httpAddr
+	reasonOnce sync.Once
+	reason     string
+}
+
+// newSSEConn sends the event stream headers and returns the stream
+func newSSEConn(w http.ResponseWriter, r *http.Request) (*sseConn, error) {
+	c := &sseConn{w: w, controller: http.NewResponseController(w), remoteAddr: httpAddr(r.RemoteAddr)}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // keep reverse proxies from buffering the stream
+	w.WriteHeader(http.StatusOK)
+	if err := c.controller.Flush(); err != nil {
+		return nil, fmt.Errorf("streaming not supported: %w", err)
+	}
+	return c, nil
+}
+
+// write sends raw event stream text and flushes it, within the write timeout
+func (c *sseConn) write(text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.controller.SetWriteDeadline(time.Now().Add(*WSWriteTimeout))
+	if _, err := io.WriteString(c.w, text); err != nil {
+		c.setCloseReason("write error")
+		return err
+	}
+	if err := c.controller.Flush(); err != nil {
+		c.setCloseReason("write error")
+		return err
+	}
+	return nil
+}
+
+// WriteJSON sends one event
+func (c *sseConn) WriteJSON(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var event strings.Builder
+	if msg, ok := v.(WSMessage); ok && msg.Seq > 0 {
+		fmt.Fprintf(&event, "id: %s:%d\n", msg.Session, msg.Seq)
+	}
+	fmt.Fprintf(&event, "data: %s\n\n", data)
+	return c.write(event.String())
+}
+
+// WriteMessage is only used for binary frames, which an event stream cannot carry
+func (c *sseConn) WriteMessage(messageType int, data []byte) error {
+	return errors.New("event streams only carry JSON messages")
+}
+
+func (c *sseConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+// Subprotocol is always empty: event streams have no binary mode
+func (c *sseConn) Subprotocol() string { return "" }
+
+func (c *sseConn) setCloseReason(reason string) {
+	c.reasonOnce.Do(func() { c.reason = reason })
+}
+
+// closeWith records why the stream ends; the handler returns once the client's write loop stops
+func (c *sseConn) closeWith(code int, reason string) {
+	c.setCloseReason(reason)
+}
+
+// keepalive writes a comment line every --ws-ping-interval so proxies do not time out an idle stream
+func (c *sseConn) keepalive(stop <-chan struct{}) {
+	if *WSPingInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(*WSPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := c.write(": ping\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// parseEventID splits a Last-Event-ID of the form "<session>:<seq>". An empty ID starts a new session.
+func parseEventID(id string) (string, uint64, error) {
+	if id == "" {
+		return "", 0, nil
+	}
+	token, seq, found := strings.Cut(id, ":")
+	if !found {
+		return "", 0, fmt.Errorf("invalid event ID %q, want <session>:<seq>", id)
+	}
+	lastSeq, err := strconv.ParseUint(seq, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid event ID %q: %v", id, err)
+	}
+	return token, lastSeq, nil
+}
+
+// handleEventsSSE serves GET /buyer/p2p/events and /seller/p2p/events: the inbound messages of the hub as a
+// Server-Sent Events stream. A reconnecting EventSource sends Last-Event-ID and resumes its session, with the
+// messages it missed replayed like on a WebSocket resume. Clients that cannot set the header may pass
+// ?lastEventId= instead.
+func handleEventsSSE(w http.ResponseWriter, r *http.Request, hub *Hub) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	token, lastSeq, err := parseEventID(lastEventID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := newSSEConn(w, r)
+	if err != nil {
+		log.Printf("Cannot stream events to %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	client := hub.Register(conn, token, lastSeq, "")
+	defer hub.Unregister(client)
+
+	// The stream ends when the client goes away or the server shuts down
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-r.Context().Done():
+			conn.setCloseReason("client closed")
+		case <-stopStreams:
+			conn.setCloseReason("server shutting down")
+		}
+	}()
+
+	// The write loop also returns when the hub closes the client, without done closing, so the keepalive gets
+	// its own stop and is waited for: nothing may write to the ResponseWriter once the handler returns
+	stopKeepalive := make(chan struct{})
+	var keepalive sync.WaitGroup
+	keepalive.Add(1)
+	go func() {
+		defer keepalive.Done()
+		conn.keepalive(stopKeepalive)
+	}()
+	client.writePump(done)
+	close(stopKeepalive)
+	keepalive.Wait()
+
+	conn.setCloseReason("server closed")
+	count := countCloseReason(hub.name+" events", conn.reason)
+	log.Printf("Closed %s events stream to %s: %s (%d so far)", hub.name, r.RemoteAddr, conn.reason, count)
+}
+
+// handleSendHTTP serves POST /buyer/p2p/send and /seller/p2p/send. The body is a SendRequest; the send goes
+// through the same queue as WebSocket sends and the response is its result, with the HTTP status derived
+// from the error code. Each remote host gets its own per-client rate limit.
+func handleSendHTTP(w http.ResponseWriter, r *http.Request, wsToP2P *SendQueue, sendLimit *callerRateLimiter) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if retryAfter, ok := sendLimit.take(r.RemoteAddr); !ok {
+		writeReply(w, rateLimitedMessage("this HTTP caller", retryAfter))
+		return
+	}
+
+	var request SendRequest
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, *WSMaxFrameBytes)).Decode(&request)
+	if err != nil {
+		reply := WSMessage{
+			Type:      "error",
+			Data:      fmt.Sprintf("Error parsing send request: %v", err),
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "PARSE_ERROR",
+		}
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			reply.Data = fmt.Sprintf("Request body exceeds the limit of %d bytes", tooLarge.Limit)
+			reply.Error = "MESSAGE_TOO_LARGE"
+		}
+		writeReply(w, reply)
+		return
+	}
+
+	replies := make(chan WSMessage, 1)
+	pushed := wsToP2P.Push(ClientMessage{
+		Message: WSMessage{
+			Type:       "p2p",
+			Data:       request.Data,
+			Timestamp:  time.Now().UnixMilli(),
+			PublicKey:  request.PublicKey,
+			PublicKeys: request.PublicKeys,
+			Protocol:   request.Protocol,
+		},
+		Respond: func(reply WSMessage) {
+			replies <- reply
+		},
+	})
+	if !pushed {
+		writeReply(w, WSMessage{
+			Type:      "error",
+			Data:      "The node is shutting down and no longer sends messages",
+			Timestamp: time.Now().UnixMilli(),
+			Error:     "SHUTTING_DOWN",
+		})
+		return
+	}
+
+	select {
+	case reply := <-replies:
+		writeReply(w, reply)
+	case <-r.Context().Done():
+		log.Printf("Client %s went away before its send to %s completed", r.RemoteAddr, request.PublicKey)
+	}
+}
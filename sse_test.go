@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseEventID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		token   string
+		lastSeq uint64
+		wantErr bool
+	}{
+		{"new session", "", "", 0, false},
+		{"resume", "3f2a9c:42", "3f2a9c", 42, false},
+		{"resume from the start", "3f2a9c:0", "3f2a9c", 0, false},
+		{"largest sequence number", "3f2a9c:18446744073709551615", "3f2a9c", 18446744073709551615, false},
+		{"no separator", "3f2a9c", "", 0, true},
+		{"no sequence number", "3f2a9c:", "", 0, true},
+		{"negative sequence number", "3f2a9c:-1", "", 0, true},
+		{"sequence number overflows", "3f2a9c:18446744073709551616", "", 0, true},
+		{"not a number", "3f2a9c:abc", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, lastSeq, err := parseEventID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error: %t", err, tt.wantErr)
+			}
+			if token != tt.token || lastSeq != tt.lastSeq {
+				t.Errorf("parseEventID(%q) = %q, %d, want %q, %d", tt.id, token, lastSeq, tt.token, tt.lastSeq)
+			}
+		})
+	}
+}
+
+func TestSendHTTPRateLimitPerCaller(t *testing.T) {
+	queue := answerSends(t, WSMessage{Type: "success", Data: "sent"})
+	limit := newCallerRateLimiter(0.01, 1)
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/buyer/p2p/send", strings.NewReader(`{"publicKey": "02ab", "data": "hello"}`))
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handleSendHTTP(w, r, queue, limit)
+		return w
+	}
+
+	if w := send("192.0.2.1:40000"); w.Code != http.StatusOK {
+		t.Fatalf("first send: status %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	w := send("192.0.2.1:40001")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second send from the same host: status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Errorf("Retry-After = %q, want a positive number of seconds", retryAfter)
+	}
+	var reply WSMessage
+	if err := json.NewDecoder(w.Body).Decode(&reply); err != nil {
+		t.Fatalf("decoding the reply: %v", err)
+	}
+	if reply.Type != "error" || reply.Error != "RATE_LIMITED" || reply.RetryAfterMs <= 0 {
+		t.Errorf("reply = %+v, want a RATE_LIMITED error with retryAfterMs", reply)
+	}
+
+	if w := send("192.0.2.2:40000"); w.Code != http.StatusOK {
+		t.Errorf("send from another host: status %d, want %d", w.Code, http.StatusOK)
+	}
+}
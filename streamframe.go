@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// P2P messages travel on the libp2p stream as frames: the payload length as an unsigned varint, followed by
+// the payload. A stream may split or merge the bytes of consecutive writes, so the length prefix is what
+// turns each WebSocket send into exactly one WebSocket message on the receiving side.
+
+// errFrameTooLarge is returned for a frame whose payload is over the receive limit
+var errFrameTooLarge = errors.New("frame too large")
+
+// encodeStreamFrame returns the frame carrying payload
+func encodeStreamFrame(payload []byte) []byte {
+	frame := make([]byte, 0, binary.MaxVarintLen64+len(payload))
+	frame = binary.AppendUvarint(frame, uint64(len(payload)))
+	return append(frame, payload...)
+}
+
+// readStreamFrame reads the next frame and returns its payload, stored in buf when it is large enough and in a new
+// buffer otherwise; the caller can pass the returned slice back in to reuse it. A frame larger than maxSize is
+// reported with errFrameTooLarge without reading its payload, so the stream cannot be read any further.
+func readStreamFrame(r *bufio.Reader, maxSize int, buf []byte) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return buf, err
+	}
+	if size > uint64(maxSize) {
+		return buf, fmt.Errorf("%w: %d bytes, limit %d", errFrameTooLarge, size, maxSize)
+	}
+	if uint64(cap(buf)) < size {
+		buf = make([]byte, size)
+	}
+	payload := buf[:size]
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return buf, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+)
+
+func TestStreamFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		payloads [][]byte
+	}{
+		{"empty payload", [][]byte{{}}},
+		{"one byte length", [][]byte{[]byte("hello")}},
+		{"two byte length", [][]byte{bytes.Repeat([]byte{0xab}, 300)}},
+		{"at the limit", [][]byte{bytes.Repeat([]byte("x"), 1024)}},
+		{"consecutive frames", [][]byte{[]byte("one"), {}, []byte("three"), {0, 1, 2}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			for _, payload := range tt.payloads {
+				stream.Write(encodeStreamFrame(payload))
+			}
+			r := bufio.NewReader(&stream)
+			var buf []byte
+			for i, want := range tt.payloads {
+				payload, err := readStreamFrame(r, 1024, buf)
+				if err != nil {
+					t.Fatalf("frame %d: %v", i, err)
+				}
+				if !bytes.Equal(payload, want) {
+					t.Fatalf("frame %d = %q, want %q", i, payload, want)
+				}
+				buf = payload
+			}
+			if _, err := readStreamFrame(r, 1024, buf); err != io.EOF {
+				t.Errorf("after the last frame: err = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestReadStreamFrameReusesBuffer(t *testing.T) {
+	buf := make([]byte, 0, 16)
+	payload, err := readStreamFrame(bufio.NewReader(bytes.NewReader(encodeStreamFrame([]byte("abc")))), 1024, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if &payload[0] != &buf[:1][0] {
+		t.Errorf("payload was not read into the given buffer")
+	}
+}
+
+func TestReadStreamFrameErrors(t *testing.T) {
+	uvarint := func(size uint64) []byte { return binary.AppendUvarint(nil, size) }
+	tests := []struct {
+		name  string
+		input []byte
+		want  error
+	}{
+		{"no frame", nil, io.EOF},
+		{"truncated length", []byte{0x80}, io.ErrUnexpectedEOF},
+		{"truncated payload", append(uvarint(5), "abc"...), io.ErrUnexpectedEOF},
+		{"missing payload", uvarint(5), io.EOF},
+		{"over the limit", append(uvarint(1025), make([]byte, 1025)...), errFrameTooLarge},
+		{"over the limit without payload", uvarint(1 << 40), errFrameTooLarge},
+		{"over MaxInt64", uvarint(math.MaxInt64 + 1), errFrameTooLarge},
+		{"largest length", uvarint(math.MaxUint64), errFrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readStreamFrame(bufio.NewReader(bytes.NewReader(tt.input)), 1024, nil)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// streamSearchMaxDelay is the slowest pace at which a connection is searched for the stream the SDK opens on it
+const streamSearchMaxDelay = 2 * time.Second
+
+// streamOpenTimeout bounds opening a stream of an additional protocol, including the protocol negotiation
+const streamOpenTimeout = 10 * time.Second
+
+// streamRegistry tracks the P2P streams that have a reader, keyed by stream ID, so every stream is read by
+// exactly one goroutine however often it is discovered
+type streamRegistry struct {
+	ctx         context.Context // readers stop when it ends
+	b           *commonlib.NodeBuffers
+	hub         *Hub
+	protocols   protocolSet
+	mu          sync.Mutex
+	readers     map[string]struct{}
+	searching   map[string]struct{} // IDs of the connections being searched for the SDK's stream
+	searchConns bool                // set by watchConnections
+}
+
+func newStreamRegistry(ctx context.Context, b *commonlib.NodeBuffers, hub *Hub, protocols protocolSet) *streamRegistry {
+	return &streamRegistry{
+		ctx:       ctx,
+		b:         b,
+		hub:       hub,
+		protocols: protocols,
+		readers:   make(map[string]struct{}),
+		searching: make(map[string]struct{}),
+	}
+}
+
+// read starts a reader goroutine for the stream unless it already has one
+func (r *streamRegistry) read(stream network.Stream) {
+	id := stream.ID()
+	r.mu.Lock()
+	if _, reading := r.readers[id]; reading {
+		r.mu.Unlock()
+		return
+	}
+	r.readers[id] = struct{}{}
+	count := len(r.readers)
+	r.mu.Unlock()
+
+	log.Printf("Reading stream %s from peer %s (%d streams)", id, stream.Conn().RemotePeer(), count)
+	go func() {
+		handleStream(r.ctx, stream, r.b, r.hub)
+
+		r.mu.Lock()
+		delete(r.readers, id)
+		searchConns := r.searchConns
+		r.mu.Unlock()
+
+		// The SDK replaces a stream that ended on a connection that is still open with a new one on that connection
+		conn := stream.Conn()
+		if searchConns && stream.Protocol() == r.protocols.primary() && !conn.IsClosed() && r.ctx.Err() == nil {
+			go r.search(conn, id)
+		}
+	}()
+}
+
+// discover starts readers for the streams of our protocols on a connection, except the ended stream skip, and
+// reports whether the connection has a stream of the primary protocol, the one the SDK opens
+func (r *streamRegistry) discover(conn network.Conn, skip string) bool {
+	found := false
+	for _, stream := range conn.GetStreams() {
+		if stream.ID() == skip || !r.protocols.has(stream.Protocol()) {
+			continue
+		}
+		r.read(stream)
+		if stream.Protocol() == r.protocols.primary() {
+			found = true
+		}
+	}
+	return found
+}
+
+// watchConnections reads the streams the SDK opens itself, which is what a seller does: it connects to a buyer
+// and opens the stream right away. Every new connection is therefore searched until its stream has a reader, and
+// a connection is searched again when that reader ends while the connection stays open, for the stream the SDK
+// opens in its place.
+func (r *streamRegistry) watchConnections(h host.Host) {
+	r.mu.Lock()
+	r.searchConns = true
+	r.mu.Unlock()
+
+	watcher := &network.NotifyBundle{
+		ConnectedF: func(_ network.Network, conn network.Conn) {
+			go r.search(conn, "")
+		},
+	}
+	h.Network().Notify(watcher)
+	for _, conn := range h.Network().Conns() {
+		go r.search(conn, "")
+	}
+	go func() {
+		<-r.ctx.Done()
+		h.Network().StopNotify(watcher)
+	}()
+}
+
+// search looks for the SDK's stream on a connection, ignoring the ended stream skip, and stops as soon as it has
+// a reader, when the connection closes or the registry's context ends. The stream usually appears within
+// milliseconds of the connection, so the search starts fast and backs off to streamSearchMaxDelay; the SDK may
+// also open it much later, after its reconnect backoff or a fresh Hedera request, so it never gives up on an open
+// connection.
+func (r *streamRegistry) search(conn network.Conn, skip string) {
+	id := conn.ID()
+	r.mu.Lock()
+	if _, searching := r.searching[id]; searching {
+		r.mu.Unlock()
+		return
+	}
+	r.searching[id] = struct{}{}
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.searching, id)
+		r.mu.Unlock()
+	}()
+
+	delay := 50 * time.Millisecond
+	for !conn.IsClosed() {
+		if r.discover(conn, skip) {
+			return
+		}
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, streamSearchMaxDelay)
+	}
+}
+
+// ensureStream makes sure there is a stream of the protocol to the peer, so that WriteAndFlushBuffer finds one.
+// Streams of the primary protocol are the SDK's; the send checks that they have a reader, so a reply from the
+// peer is not lost while the connection search waits for its next round. Streams of the other protocols are
+// opened on the first send by whichever side sends first; the other side's stream handler reads them, and both
+// sides write on them.
+func (r *streamRegistry) ensureStream(h host.Host, peerID peer.ID, protocolID protocol.ID) error {
+	if protocolID == r.protocols.primary() {
+		for _, conn := range h.Network().ConnsToPeer(peerID) {
+			r.discover(conn, "")
+		}
+		return nil
+	}
+	for _, conn := range h.Network().ConnsToPeer(peerID) {
+		for _, stream := range conn.GetStreams() {
+			if stream.Protocol() == protocolID {
+				return nil
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.ctx, streamOpenTimeout)
+	defer cancel()
+	stream, err := h.NewStream(ctx, peerID, protocolID)
+	if err != nil {
+		return fmt.Errorf("cannot open a %s stream: %w", protocolID, err)
+	}
+	// NewStream may defer the protocol negotiation to the first write, but WriteAndFlushBuffer writes to the
+	// stream it finds on the connection, underneath that negotiation. An empty write sends the negotiation now.
+	if _, err := stream.Write(nil); err != nil {
+		stream.Reset()
+		return fmt.Errorf("cannot open a %s stream: %w", protocolID, err)
+	}
+	r.read(stream)
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	commonlib "github.com/NeuronInnovations/neuron-go-hedera-sdk/common-lib"
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+)
+
+// connectedHosts returns two connected hosts. The second one accepts streams of protocol and hands them over.
+func connectedHosts(t *testing.T, ctx context.Context, protocolID protocol.ID) (host.Host, host.Host, chan network.Stream) {
+	t.Helper()
+	seller, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { seller.Close() })
+	buyer, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { buyer.Close() })
+
+	accepted := make(chan network.Stream, 1)
+	buyer.SetStreamHandler(protocolID, func(stream network.Stream) { accepted <- stream })
+	if err := seller.Connect(ctx, peer.AddrInfo{ID: buyer.ID(), Addrs: buyer.Addrs()}); err != nil {
+		t.Fatal(err)
+	}
+	return seller, buyer, accepted
+}
+
+// openSDKStream opens a stream the way the SDK does on a seller and returns the buyer's end of it
+func openSDKStream(t *testing.T, ctx context.Context, seller host.Host, buyer host.Host, accepted chan network.Stream, protocolID protocol.ID) network.Stream {
+	t.Helper()
+	stream, err := seller.NewStream(ctx, buyer.ID(), protocolID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write(nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case remote := <-accepted:
+		return remote
+	case <-time.After(5 * time.Second):
+		t.Fatal("buyer did not accept the stream")
+		return nil
+	}
+}
+
+func TestSearchFindsLateStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seller, buyer, accepted := connectedHosts(t, ctx, "/late/v1")
+
+	hub := NewHub("test", 16, PolicyDropNewest, 0, time.Minute, 0)
+	client := hub.Register(testConn{}, "", 0, "")
+	defer hub.Unregister(client)
+	streams := newStreamRegistry(ctx, commonlib.NewNodeBuffers(), hub, protocolSet{"/late/v1"})
+	streams.watchConnections(seller)
+
+	// Past the fast start of the search, which then looks every streamSearchMaxDelay
+	time.Sleep(4 * time.Second)
+	remote := openSDKStream(t, ctx, seller, buyer, accepted, "/late/v1")
+	if _, err := remote.Write(encodeStreamFrame([]byte("late hello"))); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-client.send:
+		if string(msg.Raw) != "late hello" {
+			t.Errorf("received %q", msg.Raw)
+		}
+	case <-time.After(streamSearchMaxDelay + 3*time.Second):
+		t.Fatal("the late stream was not read")
+	}
+}
+
+func TestEnsureStreamReadsSDKStream(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	seller, buyer, accepted := connectedHosts(t, ctx, "/send/v1")
+
+	hub := NewHub("test", 16, PolicyDropNewest, 0, time.Minute, 0)
+	streams := newStreamRegistry(ctx, commonlib.NewNodeBuffers(), hub, protocolSet{"/send/v1"})
+	openSDKStream(t, ctx, seller, buyer, accepted, "/send/v1")
+
+	// No connection search runs here: the send alone finds the stream
+	if err := streams.ensureStream(seller, buyer.ID(), "/send/v1"); err != nil {
+		t.Fatal(err)
+	}
+	streams.mu.Lock()
+	readers := len(streams.readers)
+	streams.mu.Unlock()
+	if readers != 1 {
+		t.Errorf("%d streams read after a send, want 1", readers)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SubscriptionFilter restricts which broadcast messages a client receives. An empty list matches everything,
+// so a client that never subscribes keeps receiving all traffic.
+type SubscriptionFilter struct {
+	PublicKeys []string `json:"publicKeys,omitempty"` // sender public keys (hex)
+	Types      []string `json:"types,omitempty"`      // message types, e.g. "p2p", "topic", "error", "success"
+	Protocols  []string `json:"protocols,omitempty"`  // libp2p protocol IDs
+}
+
+// Matches reports whether a message passes the filter
+func (f *SubscriptionFilter) Matches(msg WSMessage) bool {
+	if f == nil {
+		return true
+	}
+	return matchesAny(f.PublicKeys, msg.PublicKey, true) &&
+		matchesAny(f.Types, msg.Type, false) &&
+		matchesAny(f.Protocols, msg.Protocol, false)
+}
+
+// AllowsType reports whether the filter lets through messages of the given type. Direct replies to a client
+// are only checked against the type list, since they are not tied to a sender or protocol.
+func (f *SubscriptionFilter) AllowsType(msgType string) bool {
+	if f == nil {
+		return true
+	}
+	return matchesAny(f.Types, msgType, false)
+}
+
+// matchesAny reports whether value is in list; an empty list matches every value
+func matchesAny(list []string, value string, ignoreCase bool) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value || (ignoreCase && strings.EqualFold(item, value)) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleSubscription applies a subscribe or unsubscribe message to the client and returns the reply
+func handleSubscription(client *Client, msg WSMessage) WSMessage {
+	if msg.Type == "unsubscribe" {
+		client.SetFilter(nil)
+		return replyTo(msg, WSMessage{
+			Type:      "success",
+			Data:      "Subscription cleared, receiving all messages",
+			Timestamp: time.Now().UnixMilli(),
+		})
+	}
+
+	filter := &SubscriptionFilter{}
+	if msg.Data != nil && msg.Data != "" {
+		if err := decodeData(msg.Data, filter); err != nil {
+			return replyTo(msg, WSMessage{
+				Type:      "error",
+				Data:      fmt.Sprintf("Error parsing subscribe request: %v", err),
+				Timestamp: time.Now().UnixMilli(),
+				Error:     "PARSE_ERROR",
+			})
+		}
+	}
+	client.SetFilter(filter)
+
+	return replyTo(msg, WSMessage{
+		Type:      "subscribed",
+		Data:      client.session.filter.Load(), // the filter in effect, pinned to the endpoint's protocol if it has one
+		Timestamp: time.Now().UnixMilli(),
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestSubscriptionFilterMatches(t *testing.T) {
+	const key = "02c7370bf416ee6e9f9a430a12869c456d93db6b7392a9f90d0db8981190f47153"
+	received := WSMessage{Type: "p2p", PublicKey: key, Protocol: "nrn-nodered/v2"}
+	topic := WSMessage{Type: "topic"}
+
+	tests := []struct {
+		name   string
+		filter *SubscriptionFilter
+		msg    WSMessage
+		want   bool
+	}{
+		{"no filter", nil, received, true},
+		{"empty filter", &SubscriptionFilter{}, received, true},
+		{"type listed", &SubscriptionFilter{Types: []string{"error", "p2p"}}, received, true},
+		{"type not listed", &SubscriptionFilter{Types: []string{"error"}}, received, false},
+		{"type is case sensitive", &SubscriptionFilter{Types: []string{"P2P"}}, received, false},
+		{"topic type", &SubscriptionFilter{Types: []string{"topic"}}, topic, true},
+		{"public key listed", &SubscriptionFilter{PublicKeys: []string{key}}, received, true},
+		{"public key in upper case", &SubscriptionFilter{PublicKeys: []string{"02C7370BF416EE6E9F9A430A12869C456D93DB6B7392A9F90D0DB8981190F47153"}}, received, true},
+		{"other public key", &SubscriptionFilter{PublicKeys: []string{"03aa"}}, received, false},
+		{"message without public key", &SubscriptionFilter{PublicKeys: []string{key}}, topic, false},
+		{"protocol listed", &SubscriptionFilter{Protocols: []string{"nrn-nodered/v2"}}, received, true},
+		{"other protocol", &SubscriptionFilter{Protocols: []string{"other/v1"}}, received, false},
+		{"every list matches", &SubscriptionFilter{PublicKeys: []string{key}, Types: []string{"p2p"}, Protocols: []string{"nrn-nodered/v2"}}, received, true},
+		{"one list fails", &SubscriptionFilter{PublicKeys: []string{key}, Types: []string{"error"}, Protocols: []string{"nrn-nodered/v2"}}, received, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Matches(tt.msg); got != tt.want {
+				t.Errorf("Matches(%+v) = %t, want %t", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubscriptionFilterAllowsType(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  *SubscriptionFilter
+		msgType string
+		want    bool
+	}{
+		{"no filter", nil, "success", true},
+		{"no type list", &SubscriptionFilter{PublicKeys: []string{"03aa"}}, "success", true},
+		{"type listed", &SubscriptionFilter{Types: []string{"success"}}, "success", true},
+		{"type not listed", &SubscriptionFilter{Types: []string{"p2p"}}, "error", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.AllowsType(tt.msgType); got != tt.want {
+				t.Errorf("AllowsType(%q) = %t, want %t", tt.msgType, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// certReloader serves a certificate loaded from disk and reloads it when the process receives SIGHUP,
+// so renewed certificates are picked up without dropping connections
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// newCertReloader loads the certificate and key and starts watching for SIGHUP
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	reloader := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := reloader.reload(); err != nil {
+		return nil, err
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloader.reload(); err != nil {
+				log.Printf("Keeping the current TLS certificate, reload failed: %v", err)
+			}
+		}
+	}()
+	return reloader, nil
+}
+
+// reload reads the certificate and key from disk and swaps them in
+func (c *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate %s and key %s: %w", c.certFile, c.keyFile, err)
+	}
+	c.cert.Store(&cert)
+	log.Printf("Loaded TLS certificate %s", c.certFile)
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// serverTLSConfig builds the TLS configuration from the --tls-* flags. It returns nil when TLS is disabled.
+//
+// With --tls-cert and --tls-key the certificate is read from disk and reloaded on SIGHUP. With --tls-self-signed
+// a self-signed certificate for local development is generated: it is written to --tls-cert and --tls-key when
+// those are given but do not exist yet, and otherwise kept in memory only.
+func serverTLSConfig() (*tls.Config, error) {
+	if *TLSCertFile == "" && *TLSKeyFile == "" && !*TLSSelfSigned {
+		return nil, nil
+	}
+	if (*TLSCertFile == "") != (*TLSKeyFile == "") {
+		return nil, errors.New("--tls-cert and --tls-key must be given together")
+	}
+
+	if *TLSSelfSigned {
+		if *TLSCertFile == "" {
+			cert, _, _, err := generateSelfSignedCertificate()
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Serving an in-memory self-signed TLS certificate; browsers will warn about it")
+			return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+		}
+		if _, err := os.Stat(*TLSCertFile); errors.Is(err, os.ErrNotExist) {
+			if err := writeSelfSignedCertificate(*TLSCertFile, *TLSKeyFile); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	reloader, err := newCertReloader(*TLSCertFile, *TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: tls.VersionTLS12}, nil
+}
+
+// generateSelfSignedCertificate creates a certificate valid for a year for localhost and this machine's host name.
+// It returns the certificate together with its PEM encoded certificate and key.
+func generateSelfSignedCertificate() (tls.Certificate, []byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("generating TLS key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("generating certificate serial number: %w", err)
+	}
+
+	dnsNames := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		dnsNames = append(dnsNames, hostname)
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Neuron SDK WebSocket Wrapper (self-signed)"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              dnsNames,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("creating self-signed certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, fmt.Errorf("encoding TLS key: %w", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	return cert, certPEM, keyPEM, err
+}
+
+// writeSelfSignedCertificate generates a self-signed certificate and stores it in the given files
+func writeSelfSignedCertificate(certFile string, keyFile string) error {
+	_, certPEM, keyPEM, err := generateSelfSignedCertificate()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("writing TLS key: %w", err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return fmt.Errorf("writing TLS certificate: %w", err)
+	}
+	log.Printf("Generated self-signed TLS certificate %s and key %s", certFile, keyFile)
+	return nil
+}
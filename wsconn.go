@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// closeReasonCounts counts how WebSocket connections ended, keyed by endpoint and reason
+var closeReasonCounts = struct {
+	sync.Mutex
+	counts map[string]uint64
+}{counts: make(map[string]uint64)}
+
+// countCloseReason records one closed connection and returns how many have closed for the same endpoint and reason
+func countCloseReason(endpoint string, reason string) uint64 {
+	closeReasonCounts.Lock()
+	defer closeReasonCounts.Unlock()
+	key := endpoint + ": " + reason
+	closeReasonCounts.counts[key]++
+	return closeReasonCounts.counts[key]
+}
+
+// activeWSConns holds every open WebSocket connection so shutdown can close them all
+var activeWSConns = struct {
+	sync.Mutex
+	conns map[*wsConn]struct{}
+}{conns: make(map[*wsConn]struct{})}
+
+// closeAllWSConns sends a close frame with the given code and reason to every open connection and closes it
+func closeAllWSConns(code int, reason string) {
+	activeWSConns.Lock()
+	defer activeWSConns.Unlock()
+	for conn := range activeWSConns.conns {
+		go conn.closeWith(code, reason)
+	}
+}
+
+// countWSConns returns how many WebSocket connections are open
+func countWSConns() int {
+	activeWSConns.Lock()
+	defer activeWSConns.Unlock()
+	return len(activeWSConns.conns)
+}
+
+// wsConn wraps a WebSocket connection with read/write deadlines, keepalive pings, idle detection
+// and accounting of why the connection was closed
+type wsConn struct {
+	*websocket.Conn
+	endpoint     string
+	lastActivity atomic.Int64 // unix millis of the last application message read from the client
+	reasonOnce   sync.Once
+	reason       string
+}
+
+// newWSConn installs the read limit, the pong handler and the initial read deadline on a freshly upgraded
+// connection. A message larger than readLimit bytes makes the connection close with CloseMessageTooBig.
+func newWSConn(conn *websocket.Conn, endpoint string, readLimit int64) *wsConn {
+	c := &wsConn{Conn: conn, endpoint: endpoint}
+	c.lastActivity.Store(time.Now().UnixMilli())
+	conn.SetReadLimit(readLimit)
+
+	activeWSConns.Lock()
+	activeWSConns.conns[c] = struct{}{}
+	activeWSConns.Unlock()
+
+	if *WSPongTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(*WSPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(*WSPongTimeout))
+		})
+	}
+	return c
+}
+
+// ReadMessage reads the next message, extending the read deadline and recording the close reason on failure
+func (c *wsConn) ReadMessage() (int, []byte, error) {
+	messageType, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		c.setCloseReason(readCloseReason(err))
+		return messageType, data, err
+	}
+	c.lastActivity.Store(time.Now().UnixMilli())
+	if *WSPongTimeout > 0 {
+		c.SetReadDeadline(time.Now().Add(*WSPongTimeout))
+	}
+	return messageType, data, nil
+}
+
+// ReadJSON reads the next message and decodes it as JSON into v
+func (c *wsConn) ReadJSON(v interface{}) error {
+	_, data, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteMessage writes a single frame within the configured write timeout
+func (c *wsConn) WriteMessage(messageType int, data []byte) error {
+	c.SetWriteDeadline(time.Now().Add(*WSWriteTimeout))
+	return c.writeFailed(c.Conn.WriteMessage(messageType, data))
+}
+
+// WriteJSON writes a message within the configured write timeout
+func (c *wsConn) WriteJSON(v interface{}) error {
+	c.SetWriteDeadline(time.Now().Add(*WSWriteTimeout))
+	return c.writeFailed(c.Conn.WriteJSON(v))
+}
+
+// writeFailed records the close reason for a failed write and passes the error through
+func (c *wsConn) writeFailed(err error) error {
+	if err == nil {
+		return nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		c.setCloseReason("write timeout")
+	} else {
+		c.setCloseReason("write error")
+	}
+	return err
+}
+
+// keepalive pings the client every --ws-ping-interval and closes the connection once it has been idle
+// for --ws-idle-timeout. It returns when stop is closed or the connection has been closed.
+func (c *wsConn) keepalive(stop <-chan struct{}) {
+	interval := *WSPingInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if *WSIdleTimeout > 0 && time.Since(time.UnixMilli(c.lastActivity.Load())) > *WSIdleTimeout {
+				c.closeWith(websocket.CloseNormalClosure, "idle timeout")
+				return
+			}
+			if *WSPingInterval <= 0 {
+				continue
+			}
+			deadline := time.Now().Add(*WSWriteTimeout)
+			if err := c.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				c.setCloseReason("ping failed")
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// closeWith records the reason, sends a close frame with the given code and closes the connection
+func (c *wsConn) closeWith(code int, reason string) {
+	c.setCloseReason(reason)
+	deadline := time.Now().Add(time.Second)
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), deadline)
+	c.Close()
+}
+
+// setCloseReason records why the connection ended; only the first reason is kept
+func (c *wsConn) setCloseReason(reason string) {
+	c.reasonOnce.Do(func() { c.reason = reason })
+}
+
+// finish closes the connection and logs and counts the close reason. Call it once when the handler returns.
+func (c *wsConn) finish() {
+	c.setCloseReason("server closed")
+	c.Close()
+
+	activeWSConns.Lock()
+	delete(activeWSConns.conns, c)
+	activeWSConns.Unlock()
+
+	count := countCloseReason(c.endpoint, c.reason)
+	log.Printf("Closed %s connection from %s: %s (%d so far)", c.endpoint, c.RemoteAddr(), c.reason, count)
+}
+
+// readCloseReason classifies an error returned by a read
+func readCloseReason(err error) string {
+	if errors.Is(err, websocket.ErrReadLimit) {
+		return "message too large"
+	}
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		return fmt.Sprintf("client closed (%d)", closeErr.Code)
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "pong timeout"
+	}
+	return "read error"
+}